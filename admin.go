@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ADMIN_STATS_TIME = time.Duration(5) * time.Minute
+)
+
+// Gallery info for the admin pages
+type AdminGallery struct {
+	Key       string
+	Gallery   *GalleryConfig
+	Folders   int
+	Images    int
+	DiskUsage int64
+	Updated   time.Time
+}
+
+type AdminPage struct {
+	BaseURL      string
+	Name         string
+	Path         string
+	StaticCSS    string
+	StaticJS     string
+	Message      string
+	Galleries    []*AdminGallery
+	CacheEntries int
+	QueueDepth   int
+	QueueCurrent string
+	QueueStarted time.Time
+	Failures     map[string]map[string]FailureInfo
+	MemAlloc     int64
+	MemSys       int64
+	Goroutines   int
+}
+
+// Walking big galleries is slow, so keep the stats around for a while
+var adminStats = struct {
+	sync.Mutex
+	Galleries map[string]*AdminGallery
+}{
+	Galleries: make(map[string]*AdminGallery),
+}
+
+// Start the admin listener, if one is configured
+func AdminServer() {
+	if Config.Admin.Listen == "" {
+		return
+	}
+	if Config.Admin.Username == "" || Config.Admin.Password == "" {
+		log.Fatalf("Admin listener needs a Username and Password")
+	}
+
+	r := mux.NewRouter()
+	addStaticRoutes(r)
+
+	r.Handle("/", adminAuth(http.HandlerFunc(AdminHandler))).Methods("GET")
+	r.Handle("/flush", adminAuth(http.HandlerFunc(AdminFlushHandler))).Methods("POST")
+	r.Handle("/gc", adminAuth(http.HandlerFunc(AdminGCHandler))).Methods("POST")
+	r.Handle("/rescan", adminAuth(http.HandlerFunc(AdminRescanHandler))).Methods("POST")
+	r.Handle("/failures", adminAuth(http.HandlerFunc(FailuresHandler)))
+	r.Handle("/readyz", adminAuth(http.HandlerFunc(AdminReadyzHandler)))
+	r.Handle("/metrics", adminAuth(promhttp.Handler()))
+
+	go func() {
+		log.Info("Admin listening on %s", Config.Admin.Listen)
+		if err := http.ListenAndServe(Config.Admin.Listen, LogHandler(logWriter, r)); err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
+
+// HTTP basic auth for the admin pages, and no posting from other sites
+func adminAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkBasicAuth(r, Config.Admin.Username, Config.Admin.Password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Gollery admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !checkSameOrigin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Admin overview page
+func AdminHandler(w http.ResponseWriter, r *http.Request) {
+	// Get a Redis connection
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	failures, err := getFailureReport(conn)
+	if err != nil {
+		log.Error("AdminHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	vmCurrent.Lock()
+	queueCurrent, queueStarted := vmCurrent.BasePath, vmCurrent.Started
+	vmCurrent.Unlock()
+
+	p := &AdminPage{
+		BaseURL:      "/",
+		Name:         "Gollery admin",
+		Path:         "/",
+		StaticCSS:    staticFiles["gollery.min.css"],
+		StaticJS:     staticFiles["gollery.min.js"],
+		Message:      r.URL.Query().Get("msg"),
+		Galleries:    getAdminGalleries(r.URL.Query().Get("refresh") != ""),
+		CacheEntries: cache.Len(),
+		QueueDepth:   len(vmChan),
+		QueueCurrent: queueCurrent,
+		QueueStarted: queueStarted,
+		Failures:     failures,
+		MemAlloc:     int64(mem.Alloc),
+		MemSys:       int64(mem.Sys),
+		Goroutines:   runtime.NumGoroutine(),
+	}
+	renderTemplate(w, "admin", "", p)
+}
+
+// Flush GalleryCache entries, for one gallery or everything
+func AdminFlushHandler(w http.ResponseWriter, r *http.Request) {
+	var count int
+	if g := r.FormValue("gallery"); g != "" {
+		gallery, ok := Config.Gallery[g]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		count = cache.DeletePrefix(gallery.ImagePath)
+		forgetTree(gallery)
+		forgetDates(gallery)
+	} else {
+		count = cache.Flush()
+		flushTrees()
+		flushDates()
+	}
+
+	adminRedirect(w, r, "Flushed %d cache entries", count)
+}
+
+// Force a garbage collection and give memory back to the OS
+func AdminGCHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	runtime.GC()
+	debug.FreeOSMemory()
+
+	adminRedirect(w, r, "GC took %s", time.Since(start))
+}
+
+// Rescan a folder, optionally regenerating all of the thumbnails
+func AdminRescanHandler(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := Config.Gallery[r.FormValue("gallery")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Check path
+	cleanPath, err := gallery.resolveImagePath(r.FormValue("folder"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if fi, err := os.Stat(cleanPath); err != nil || !fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	thumbs := r.FormValue("thumbs") != ""
+	if err := rescanFolder(gallery, cleanPath, thumbs); err != nil {
+		log.Error("AdminRescanHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if thumbs {
+		adminRedirect(w, r, "Regenerating thumbnails for %s", cleanPath)
+	} else {
+		adminRedirect(w, r, "Rescanning %s", cleanPath)
+	}
+}
+
+// Report every file that failed to convert
+func FailuresHandler(w http.ResponseWriter, r *http.Request) {
+	// Get a Redis connection
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	report, err := getFailureReport(conn)
+	if err != nil {
+		log.Error("FailuresHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Error("FailuresHandler: %s", err.Error())
+	}
+}
+
+// Fetch the failure records for every tool
+func getFailureReport(conn redis.Conn) (map[string]map[string]FailureInfo, error) {
+	report := make(map[string]map[string]FailureInfo)
+	for _, key := range []string{FAILED_CONVERT, FAILED_FFMPEG} {
+		failures, err := getFailures(conn, key)
+		if err != nil {
+			return nil, err
+		}
+		report[key] = failures
+	}
+
+	return report, nil
+}
+
+// Forget everything we know about a folder and scan it again in the background
+func rescanFolder(gallery *GalleryConfig, basePath string, thumbs bool) error {
+	if thumbs {
+		// Get a Redis connection
+		conn := redisPool.Get()
+		defer conn.Close()
+
+		if _, err := conn.Do("HDEL", "images", basePath); err != nil {
+			return err
+		}
+
+		// Give files that failed another chance
+		report, err := getFailureReport(conn)
+		if err != nil {
+			return err
+		}
+		for key, failures := range report {
+			for filePath := range failures {
+				if path.Dir(filePath) == basePath {
+					if err = clearFailure(conn, key, filePath); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	cache.Delete(basePath)
+
+	go func() {
+		if _, _, _, err := tn.ScanFolder(gallery, basePath); err != nil {
+			log.Error("rescanFolder(%s): %s", basePath, err.Error())
+		}
+	}()
+
+	return nil
+}
+
+// Get stats for every gallery, sorted by key
+func getAdminGalleries(refresh bool) []*AdminGallery {
+	adminStats.Lock()
+	defer adminStats.Unlock()
+
+	var galleries []*AdminGallery
+	for key, gallery := range Config.Gallery {
+		ag, ok := adminStats.Galleries[key]
+		if !ok || refresh || time.Since(ag.Updated) > ADMIN_STATS_TIME {
+			ag = getGalleryStats(key, gallery)
+			adminStats.Galleries[key] = ag
+		}
+		galleries = append(galleries, ag)
+	}
+
+	sort.Sort(byKey(galleries))
+
+	return galleries
+}
+
+// Walk a gallery counting folders, images and bytes
+func getGalleryStats(key string, gallery *GalleryConfig) *AdminGallery {
+	ag := &AdminGallery{
+		Key:     key,
+		Gallery: gallery,
+		Updated: time.Now(),
+	}
+
+	filepath.Walk(gallery.ImagePath, func(filePath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		relPath := gallery.relPath(filePath)
+		if fi.IsDir() {
+			if filePath != gallery.ImagePath {
+				// Skip excluded folders
+				if gallery.Excluded(relPath, true) {
+					return filepath.SkipDir
+				}
+				ag.Folders++
+			}
+		} else if reImage.MatchString(fi.Name()) && !gallery.Excluded(relPath, false) {
+			ag.Images++
+			ag.DiskUsage += fi.Size()
+		}
+
+		return nil
+	})
+
+	return ag
+}
+
+type byKey []*AdminGallery
+
+func (a byKey) Len() int           { return len(a) }
+func (a byKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byKey) Less(i, j int) bool { return a[i].Key < a[j].Key }
+
+// Redirect back to the admin overview with a message
+func adminRedirect(w http.ResponseWriter, r *http.Request, format string, args ...interface{}) {
+	msg := url.QueryEscape(fmt.Sprintf(format, args...))
+	http.Redirect(w, r, "/?msg="+msg, http.StatusSeeOther)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// Hash of album slug -> JSON Album, per gallery
+	ALBUMS_KEY = "albums:%s"
+)
+
+// A hand-picked list of images from anywhere in the gallery
+type Album struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description,omitempty"`
+	Images      []string `json:"images"`
+}
+
+// Album slugs end up in URLs, keep them boring
+func validAlbumSlug(slug string) bool {
+	return slug != "" && !reNotSlug.MatchString(slug)
+}
+
+// Tidy up album image paths, they're relative to ImagePath like everywhere else
+func cleanAlbumImages(images []string) ([]string, error) {
+	out := []string{}
+	for _, imagePath := range images {
+		imagePath = strings.TrimPrefix(path.Clean("/"+imagePath), "/")
+		if imagePath == "" || !reImage.MatchString(path.Base(imagePath)) {
+			return nil, fmt.Errorf("invalid image path: %q", imagePath)
+		}
+		out = append(out, imagePath)
+	}
+	return out, nil
+}
+
+// Get every album for a gallery
+func getAlbums(conn redis.Conn, gallery *GalleryConfig) (map[string]*Album, error) {
+	values, err := redis.StringMap(conn.Do("HGETALL", fmt.Sprintf(ALBUMS_KEY, gallery.ImagePath)))
+	if err != nil {
+		return nil, err
+	}
+
+	albums := make(map[string]*Album)
+	for slug, value := range values {
+		album := &Album{}
+		if err = json.Unmarshal([]byte(value), album); err != nil {
+			log.Warning("getAlbums(%s): %s", slug, err.Error())
+			continue
+		}
+		albums[slug] = album
+	}
+
+	return albums, nil
+}
+
+// Get an album, nil if it doesn't exist
+func getAlbum(conn redis.Conn, gallery *GalleryConfig, slug string) (*Album, error) {
+	b, err := redis.Bytes(conn.Do("HGET", fmt.Sprintf(ALBUMS_KEY, gallery.ImagePath), slug))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	album := &Album{}
+	if err = json.Unmarshal(b, album); err != nil {
+		return nil, err
+	}
+	return album, nil
+}
+
+// Create or replace an album
+func saveAlbum(conn redis.Conn, gallery *GalleryConfig, slug string, album *Album) error {
+	b, err := json.Marshal(album)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", fmt.Sprintf(ALBUMS_KEY, gallery.ImagePath), slug, b)
+	return err
+}
+
+// Delete an album, the images stay where they are
+func deleteAlbum(conn redis.Conn, gallery *GalleryConfig, slug string) (bool, error) {
+	return redis.Bool(conn.Do("HDEL", fmt.Sprintf(ALBUMS_KEY, gallery.ImagePath), slug))
+}
+
+// Serve /.albums/ (all albums) and /.albums/<slug>/ (an album) as virtual folders
+func AlbumsHandler(w http.ResponseWriter, r *http.Request) {
+	// Check the gallery header
+	g := getGallery(r)
+	if g == "" {
+		http.NotFound(w, r)
+		return
+	}
+	gallery := Config.Gallery[g]
+
+	// Get a Redis connection
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	slug := strings.Trim(strings.TrimPrefix(r.URL.Path, "/.albums"), "/")
+	crumbs := []Crumb{{Name: "Albums", Path: gallery.BaseURL + ".albums/"}}
+
+	if slug == "" {
+		dirs, err := albumDirs(conn, gallery, "")
+		if err != nil {
+			log.Error("AlbumsHandler: %s", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		p := virtualPage(g, gallery, "Albums", "/.albums/", crumbs)
+		p.Dirs = dirs
+		renderTemplate(w, "gallery", g, p)
+		return
+	}
+
+	album, err := getAlbum(conn, gallery, slug)
+	if err != nil {
+		log.Error("AlbumsHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if album == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	images, err := lookupImages(conn, gallery, album.Images)
+	if err != nil {
+		log.Error("AlbumsHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	p := virtualPage(g, gallery, album.Title, r.URL.Path, append(crumbs, Crumb{Name: album.Title}))
+	p.Description = album.Description
+	p.Images = images
+	renderTemplate(w, "gallery", g, p)
+}
+
+// Albums as dirs with their first image as the cover, optionally only the ones with a
+// title containing a string
+func albumDirs(conn redis.Conn, gallery *GalleryConfig, match string) ([]DirInfo, error) {
+	albums, err := getAlbums(conn, gallery)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []DirInfo
+	for slug, album := range albums {
+		if !strings.Contains(strings.ToLower(album.Title), match) {
+			continue
+		}
+
+		thumbPath := ".static/" + staticFiles["folder.png"]
+		if len(album.Images) > 0 {
+			images, err := lookupImages(conn, gallery, album.Images[:1])
+			if err != nil {
+				return nil, err
+			}
+			if len(images) > 0 && !images[0].Broken {
+				thumbPath = ".thumbs/" + images[0].ThumbPath
+			}
+		}
+
+		dirs = append(dirs, DirInfo{gallery.BaseURL + ".albums/" + slug, album.Title, thumbPath})
+	}
+	sort.Sort(byDirName(dirs))
+
+	return dirs, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// Biggest JSON body we'll accept
+	API_MAX_BODY = 1024 * 1024
+)
+
+// Check the gallery has editing turned on and the request has the right credentials
+func checkEdit(w http.ResponseWriter, r *http.Request) (*GalleryConfig, bool) {
+	// Check the gallery header
+	g := getGallery(r)
+	if g == "" {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	gallery := Config.Gallery[g]
+
+	if gallery.EditUsername == "" || gallery.EditPassword == "" {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	if !checkBasicAuth(r, gallery.EditUsername, gallery.EditPassword) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", gallery.Name))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	// Forms can't send JSON, and browsers ask first before sending it to another site. Browsers
+	// remember credentials too, so check where the request came from as well.
+	if r.Method == "PUT" || r.Method == "POST" {
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+			writeJSON(w, http.StatusUnsupportedMediaType, map[string]interface{}{"error": "Content-Type must be application/json"})
+			return nil, false
+		}
+	}
+	if !checkSameOrigin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+
+	return gallery, true
+}
+
+// Decode a JSON request body
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, API_MAX_BODY)).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "Invalid JSON: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+// Get or set an image's tags, /.api/tags/folder/IMG_0001.jpg. PUT/POST {"tags": [...]}
+// replaces the tags added through the API, embedded keywords always stay.
+func TagsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := checkEdit(w, r)
+	if !ok {
+		return
+	}
+
+	// Check path
+	imagePath := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	fullPath, err := gallery.resolveImagePath(r.URL.Path)
+	if err != nil || !reImage.MatchString(path.Base(imagePath)) || gallery.PathExcluded(imagePath, false) {
+		http.NotFound(w, r)
+		return
+	}
+	if fi, err := os.Stat(fullPath); err != nil || !fi.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Get a Redis connection
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	fileMap, err := getFileMap(conn, path.Join(gallery.ImagePath, path.Dir(imagePath)))
+	if err != nil {
+		log.Error("TagsAPIHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	keywords := fileMap[path.Base(imagePath)].Keywords
+
+	userTags, err := getUserTags(conn, gallery, imagePath)
+	if err != nil {
+		log.Error("TagsAPIHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+
+	case "PUT", "POST":
+		var req struct {
+			Tags []string `json:"tags"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		userTags = normaliseTags(req.Tags)
+
+		if len(userTags) > 0 {
+			b, _ := json.Marshal(userTags)
+			_, err = conn.Do("HSET", fmt.Sprintf(USER_TAGS_KEY, gallery.ImagePath), imagePath, b)
+		} else {
+			_, err = conn.Do("HDEL", fmt.Sprintf(USER_TAGS_KEY, gallery.ImagePath), imagePath)
+		}
+		if err == nil {
+			err = setTags(conn, gallery, imagePath, mergeTags(keywords, userTags))
+		}
+		if err != nil {
+			log.Error("TagsAPIHandler: %s", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"path":     imagePath,
+		"tags":     mergeTags(keywords, userTags),
+		"keywords": keywords,
+		"user":     userTags,
+	})
+}
+
+// Manage albums. /.api/albums/ lists them, /.api/albums/<slug> can be fetched, created or
+// replaced with PUT/POST {"title": ..., "description": ..., "images": [...]}, or deleted.
+func AlbumsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := checkEdit(w, r)
+	if !ok {
+		return
+	}
+
+	// Get a Redis connection
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	slug := strings.Trim(r.URL.Path, "/")
+	if slug == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		albums, err := getAlbums(conn, gallery)
+		if err != nil {
+			log.Error("AlbumsAPIHandler: %s", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, albums)
+		return
+	}
+
+	if !validAlbumSlug(slug) {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "Album names can only use A-Z, 0-9, _ and -"})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		album, err := getAlbum(conn, gallery, slug)
+		if err != nil {
+			log.Error("AlbumsAPIHandler: %s", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if album == nil {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "No such album"})
+			return
+		}
+		writeJSON(w, http.StatusOK, album)
+
+	case "PUT", "POST":
+		album := &Album{}
+		if !readJSON(w, r, album) {
+			return
+		}
+		if album.Title = strings.TrimSpace(album.Title); album.Title == "" {
+			album.Title = slug
+		}
+		images, err := cleanAlbumImages(album.Images)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		album.Images = images
+
+		if err = saveAlbum(conn, gallery, slug, album); err != nil {
+			log.Error("AlbumsAPIHandler: %s", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, album)
+
+	case "DELETE":
+		deleted, err := deleteAlbum(conn, gallery, slug)
+		if err != nil {
+			log.Error("AlbumsAPIHandler: %s", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "No such album"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": slug})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Templates and static files are built in, so the binary works from anywhere
+//
+//go:embed assets/templates static
+var embeddedAssets embed.FS
+
+var (
+	templateFS fs.FS
+	staticFS   fs.FS
+)
+
+// A static file, loaded into memory with compressed variants for text types
+type staticFile struct {
+	Name   string
+	Hash   string
+	Data   []byte
+	Gzip   []byte
+	Brotli []byte
+}
+
+var staticContent = make(map[string]*staticFile)
+
+// Only bother compressing things that compress
+var compressExts = map[string]bool{
+	".css": true,
+	".js":  true,
+}
+
+// Layers of filesystems, the first one with a file wins
+type overlayFS []fs.FS
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	for _, fsys := range o {
+		f, err := fsys.Open(name)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// List the files in the top level of every layer
+func (o overlayFS) fileNames() ([]string, error) {
+	seen := make(map[string]bool)
+	var names []string
+	for _, fsys := range o {
+		entries, err := fs.ReadDir(fsys, ".")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() && !seen[entry.Name()] {
+				seen[entry.Name()] = true
+				names = append(names, entry.Name())
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Set up the template and static filesystems, then load everything
+func SetupAssets() error {
+	templates, err := fs.Sub(embeddedAssets, "assets/templates")
+	if err != nil {
+		return err
+	}
+	static, err := fs.Sub(embeddedAssets, "static")
+	if err != nil {
+		return err
+	}
+
+	// Files in AssetPath/templates and AssetPath/static replace the built-in ones
+	layers := overlayFS{templates}
+	staticLayers := overlayFS{static}
+	if Config.Global.AssetPath != "" {
+		log.Info("Loading asset overrides from %s", Config.Global.AssetPath)
+		layers = overlayFS{os.DirFS(filepath.Join(Config.Global.AssetPath, "templates")), templates}
+		staticLayers = overlayFS{os.DirFS(filepath.Join(Config.Global.AssetPath, "static")), static}
+	}
+	templateFS, staticFS = layers, staticLayers
+
+	if err = loadTemplates(); err != nil {
+		return err
+	}
+
+	return loadStatic(staticLayers)
+}
+
+// Read every static file, generate hashed filenames and compress the text ones
+func loadStatic(layers overlayFS) error {
+	fileNames, err := layers.fileNames()
+	if err != nil {
+		return err
+	}
+
+	for _, fileName := range fileNames {
+		b, err := fs.ReadFile(layers, fileName)
+		if err != nil {
+			return err
+		}
+		if err = addStaticFile(fileName, b); err != nil {
+			return err
+		}
+	}
+
+	return loadThemeCSS()
+}
+
+// Add a file to the static files, hashing and compressing it
+func addStaticFile(fileName string, b []byte) error {
+	ext := path.Ext(fileName)
+	sf := &staticFile{
+		Name: fileName,
+		Hash: fmt.Sprintf("%x", md5.Sum(b)),
+		Data: b,
+	}
+
+	if compressExts[ext] {
+		var err error
+		if sf.Gzip, err = gzipBytes(b); err != nil {
+			return err
+		}
+		if sf.Brotli, err = brotliBytes(b); err != nil {
+			return err
+		}
+	}
+
+	staticContent[fileName] = sf
+	staticFiles[fileName] = fmt.Sprintf("%s.%s%s", strings.TrimSuffix(fileName, ext), sf.Hash, ext)
+
+	return nil
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(b); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func brotliBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Serve a static file from memory, compressed if the client wants it
+func serveStaticFile(w http.ResponseWriter, r *http.Request, fileName string) {
+	sf, ok := staticContent[fileName]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, etag := sf.Data, sf.Hash
+	if sf.Gzip != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if acceptsEncoding(r, "br") {
+			data, etag = sf.Brotli, etag+"-br"
+			w.Header().Set("Content-Encoding", "br")
+		} else if acceptsEncoding(r, "gzip") {
+			data, etag = sf.Gzip, etag+"-gz"
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+
+	// Set the type ourselves, ServeContent would sniff the compressed data
+	if ctype := mime.TypeByExtension(path.Ext(fileName)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", etag))
+
+	http.ServeContent(w, r, fileName, time.Time{}, bytes.NewReader(data))
+}
+
+// Does the Accept-Encoding header allow an encoding? q=0 means no.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != encoding {
+			continue
+		}
+
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	return false
+}
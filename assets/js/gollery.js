@@ -1,3 +1,6 @@
 $(document).ready(function() {
     Grid.init();
+    Upload.init();
+    Tree.init();
+    Viewer.init();
 });
@@ -262,6 +262,10 @@ var Grid = (function() {
 		$items.on( 'click', 'span.og-close', function() {
 			hidePreview();
 			return false;
+		} ).on( 'click', 'span.og-prev, span.og-next', function() {
+			// no inline handlers, they break with a Content-Security-Policy
+			$( this ).closest( 'ul' ).children( 'li' ).eq( $( this ).data( 'index' ) ).children( 'a' ).click();
+			return false;
 		} ).children( 'a' ).on( 'click', function(e) {
 
 			var $item = $( this ).parent();
@@ -387,15 +391,29 @@ var Grid = (function() {
 					modified: $itemEl.data('modified'),
 					video: $itemEl.data('video'),
 					videosize: $itemEl.data('videosize'),
+					caption: $itemEl.data('caption'),
+					page: $itemEl.data('page'),
+					folder: $itemEl.data('folder'),
 				};
 
 			//console.log(current, $items);
 
-			this.$title.html( eldata.title );
-			this.$href.html('<a href="' + eldata.href + '" target="_blank">Original image</a>')
+			// Titles and paths come from file names and metadata, never treat them as HTML
+			this.$title.text( eldata.title );
+			this.$href.empty().append($('<a target="_blank">').attr('href', eldata.href).text('Original image'));
+			if (eldata.page) {
+				this.$href.append(' ', $('<a>').attr('href', eldata.page).text('Permalink'));
+			}
+			if (eldata.folder) {
+				this.$href.append(' ', $('<a>').attr('href', eldata.folder).text('Folder'));
+			}
 
 			// Update description
-			var html = '<p>Dimensions</p><p>' + eldata.dimensions + '</p>';
+			var html = '';
+			if (eldata.caption) {
+				html += '<p>Caption</p><p>' + $('<div>').text(eldata.caption).html() + '</p>';
+			}
+			html += '<p>Dimensions</p><p>' + eldata.dimensions + '</p>';
 			if (useVideo && eldata.video) {
 				html += '<p>File size</p><p>' + eldata.videosize + ' (' + eldata.size + ' orig)</p>';
 			}
@@ -408,12 +426,10 @@ var Grid = (function() {
 			// Update prev/next
 			html = '';
 			if (current > 0) {
-				var click = "$('.og-grid li:nth-child(" + current + ") a').click()";
-				html += '<span class="og-prev" onclick="' + click + '">&#8678;</span>';
+				html += '<span class="og-prev" data-index="' + (current - 1) + '">&#8678;</span>';
 			}
 			if (current < ($items.length - 1)) {
-				var click = "$('.og-grid li:nth-child(" + (current + 2) + ") a').click()";
-				html += '<span class="og-next" onclick="' + click + '">&#8680;</span>';
+				html += '<span class="og-next" data-index="' + (current + 1) + '">&#8680;</span>';
 			}
 			this.$prevnext.html(html);
 
@@ -431,14 +447,13 @@ var Grid = (function() {
 					this.$loading.hide();
 					self.$fullimage.find('img, video').remove();
 
-					var html = '<video autoplay loop muted="muted"><source src="' + eldata.video + '" type="video/webm"></video>';
-					self.$fullimage.append(html);
+					self.$fullimage.append($('<video autoplay loop muted="muted">').append($('<source type="video/webm">').attr('src', eldata.video)));
 
-					self.$href.append('<a href="' + eldata.video + '" target="_blank">WebM video</a>');
+					self.$href.append($('<a target="_blank">').attr('href', eldata.video).text('WebM video'));
 				}
 				else {
 					this.$loading.show();
-					$( '<img/>' ).load( function() {
+					$( '<img/>' ).on( 'load', function() {
 						var $img = $( this );
 						if( $img.attr( 'src' ) === self.$item.children('a').data( 'largesrc' ) ) {
 							self.$loading.hide();
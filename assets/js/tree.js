@@ -0,0 +1,85 @@
+var Tree = (function() {
+    var $tree, $toggle, loaded = false;
+
+    function init() {
+        $tree = $('#tree');
+        $toggle = $('#tree-toggle');
+        if ($tree.length === 0) {
+            return;
+        }
+
+        $toggle.on('click', function(e) {
+            e.preventDefault();
+            toggle(!$tree.is(':visible'));
+        });
+
+        // Expand/collapse folders
+        $tree.on('click', '.tree-expand', function(e) {
+            e.preventDefault();
+            $(this).parent().toggleClass('tree-open');
+        });
+
+        // Remember if it was open
+        if (window.localStorage && localStorage.getItem('gollery-tree') === '1') {
+            toggle(true);
+        }
+    }
+
+    function toggle(open) {
+        $tree.prop('hidden', !open);
+        $('body').toggleClass('tree-visible', open);
+        if (window.localStorage) {
+            localStorage.setItem('gollery-tree', open ? '1' : '0');
+        }
+
+        if (open && !loaded) {
+            loaded = true;
+            $.getJSON($tree.data('url'), function(root) {
+                var $ul = $('<ul>');
+                $ul.append(buildNode(root, $tree.data('base'), 0));
+                $tree.empty().append($ul);
+            }).fail(function() {
+                loaded = false;
+                $tree.text('Unable to load folders');
+            });
+        }
+    }
+
+    // Build the <li> for a folder and everything under it. Folders on the way to the
+    // current one start open.
+    function buildNode(node, nodePath, depth) {
+        var current = $tree.data('path');
+        var base = $tree.data('base');
+        // Path relative to BaseURL, like Page.Path
+        var relPath = decodeURIComponent(nodePath).substr(base.length - 1);
+        var $li = $('<li>');
+
+        if (node.d) {
+            $li.append($('<a href="#" class="tree-expand">').html('&#9656;'));
+        } else {
+            $li.append($('<span class="tree-expand-none">'));
+        }
+
+        var $a = $('<a>').attr('href', nodePath).text(node.t || (depth === 0 ? node.n : node.n.replace(/_/g, ' ')));
+        if (relPath === current) {
+            $a.addClass('tree-current');
+        }
+        $li.append($a);
+
+        if (node.d) {
+            var $ul = $('<ul>');
+            $.each(node.d, function(i, child) {
+                $ul.append(buildNode(child, nodePath + encodeURIComponent(child.n) + '/', depth + 1));
+            });
+            $li.append($ul);
+
+            if (current.indexOf(relPath) === 0) {
+                $li.addClass('tree-open');
+            }
+        }
+
+        return $li;
+    }
+
+    return { init: init };
+})();
@@ -0,0 +1,131 @@
+var Upload = (function() {
+    // Files bigger than this are sent in resumable chunks
+    var chunkSize = 4 * 1024 * 1024;
+
+    var $upload, $status, url;
+
+    function init() {
+        $upload = $('#upload');
+        if ($upload.length === 0) {
+            return;
+        }
+
+        url = $upload.data('url');
+        $status = $upload.find('.upload-status');
+
+        $upload.find('form.upload-files').on('submit', function(e) {
+            e.preventDefault();
+            uploadFiles(this.elements.files.files);
+        });
+
+        // Drag and drop anywhere on the page
+        $(document).on('dragover', function(e) {
+            e.preventDefault();
+            $upload.addClass('upload-over');
+        }).on('dragleave', function(e) {
+            $upload.removeClass('upload-over');
+        }).on('drop', function(e) {
+            e.preventDefault();
+            $upload.removeClass('upload-over');
+            uploadFiles(e.originalEvent.dataTransfer.files);
+        });
+    }
+
+    function uploadFiles(files) {
+        var queue = Array.prototype.slice.call(files);
+        var failed = 0;
+
+        var next = function() {
+            if (queue.length === 0) {
+                if (failed === 0) {
+                    window.location.reload();
+                }
+                return;
+            }
+
+            var file = queue.shift();
+            var done = function(ok, msg) {
+                if (!ok) {
+                    failed++;
+                    $status.text(file.name + ': ' + msg);
+                }
+                next();
+            };
+
+            if (file.size > chunkSize) {
+                uploadChunked(file, done);
+            } else {
+                uploadSimple(file, done);
+            }
+        };
+
+        next();
+    }
+
+    function uploadSimple(file, done) {
+        var data = new FormData();
+        data.append('files', file);
+
+        $status.text('Uploading ' + file.name + '...');
+        $.ajax({
+            url: url,
+            type: 'POST',
+            data: data,
+            processData: false,
+            contentType: false
+        }).done(function(res) {
+            var msg = res.errors[file.name];
+            done(!msg, msg);
+        }).fail(function(xhr) {
+            done(false, errorMessage(xhr));
+        });
+    }
+
+    function uploadChunked(file, done) {
+        var chunkURL = url + '?name=' + encodeURIComponent(file.name);
+
+        var sendChunk = function(offset) {
+            var end = Math.min(offset + chunkSize, file.size);
+
+            $status.text('Uploading ' + file.name + ' (' + Math.floor(offset * 100 / file.size) + '%)...');
+            $.ajax({
+                url: chunkURL + '&offset=' + offset + '&total=' + file.size,
+                type: 'POST',
+                data: file.slice(offset, end),
+                processData: false,
+                contentType: 'application/octet-stream'
+            }).done(function(res) {
+                if (res.complete) {
+                    done(true);
+                } else {
+                    sendChunk(res.offset);
+                }
+            }).fail(function(xhr) {
+                // Carry on from wherever the server got to
+                if (xhr.status === 409 && xhr.responseJSON && xhr.responseJSON.offset !== undefined) {
+                    sendChunk(xhr.responseJSON.offset);
+                } else {
+                    done(false, errorMessage(xhr));
+                }
+            });
+        };
+
+        // Find out how much the server already has so we can resume
+        $.getJSON(chunkURL).done(function(res) {
+            sendChunk(res.offset);
+        }).fail(function() {
+            sendChunk(0);
+        });
+    }
+
+    function errorMessage(xhr) {
+        if (xhr.responseJSON && xhr.responseJSON.error) {
+            return xhr.responseJSON.error;
+        }
+        return xhr.statusText;
+    }
+
+    return {
+        init: init
+    };
+})();
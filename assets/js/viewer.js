@@ -0,0 +1,232 @@
+var Viewer = (function() {
+    var $viewer, $media, $caption, $counter, $play, items = [];
+    var current = -1, interval = 5, timer = null, touchX = null;
+
+    function init() {
+        var $grid = $('#og-grid');
+        if ($grid.length === 0) {
+            return;
+        }
+
+        interval = parseInt($grid.data('slideshow'), 10) || interval;
+
+        // Everything we need is already in the grid
+        $grid.children('li').children('a').each(function() {
+            var $a = $(this);
+            var href = $a.attr('href');
+            items.push({
+                name: decodeURIComponent(href.substr(href.lastIndexOf('/') + 1)),
+                src: $a.data('preview') || $a.data('largesrc'),
+                video: $a.data('video'),
+                title: $a.data('title'),
+                caption: $a.data('caption')
+            });
+        });
+        if (items.length === 0) {
+            return;
+        }
+
+        build();
+
+        // Clicking the big image in the preview goes full screen
+        $grid.on('click', '.og-fullimg img, .og-fullimg video', function() {
+            open(indexOf($(this).closest('li').index()), false);
+        });
+        $('#slideshow').on('click', function(e) {
+            e.preventDefault();
+            open(0, true);
+        });
+
+        // Deep links look like #image=IMG_0001.jpg
+        var match = /^#image=(.+)$/.exec(window.location.hash);
+        if (match) {
+            var name = decodeURIComponent(match[1]);
+            for (var i = 0; i < items.length; i++) {
+                if (items[i].name === name) {
+                    open(i, false);
+                    break;
+                }
+            }
+        }
+    }
+
+    function indexOf(i) {
+        return Math.max(0, Math.min(i, items.length - 1));
+    }
+
+    function build() {
+        $viewer = $('<div class="viewer" tabindex="-1" hidden>');
+        $media = $('<div class="viewer-media">');
+        $caption = $('<div class="viewer-caption">');
+        $counter = $('<span class="viewer-counter">');
+        $play = $('<a href="#" class="viewer-play" title="Slideshow (space)">').html('&#9654;');
+
+        var $controls = $('<div class="viewer-controls">').append(
+            $counter,
+            $play,
+            $('<a href="#" class="viewer-close" title="Close (esc)">').html('&#10005;')
+        );
+
+        $viewer.append(
+            $media,
+            $('<a href="#" class="viewer-prev" title="Previous (left)">').html('&#8678;'),
+            $('<a href="#" class="viewer-next" title="Next (right)">').html('&#8680;'),
+            $controls,
+            $caption
+        ).appendTo('body');
+
+        $viewer.on('click', '.viewer-prev', function(e) { e.preventDefault(); show(current - 1); });
+        $viewer.on('click', '.viewer-next', function(e) { e.preventDefault(); show(current + 1); });
+        $viewer.on('click', '.viewer-close', function(e) { e.preventDefault(); close(); });
+        $viewer.on('click', '.viewer-play', function(e) { e.preventDefault(); toggleSlideshow(); });
+
+        $(document).on('keydown', function(e) {
+            if (current < 0) {
+                return;
+            }
+
+            switch (e.which) {
+            case 37: // left
+                show(current - 1);
+                break;
+            case 39: // right
+                show(current + 1);
+                break;
+            case 36: // home
+                show(0);
+                break;
+            case 35: // end
+                show(items.length - 1);
+                break;
+            case 32: // space
+                toggleSlideshow();
+                break;
+            case 27: // escape
+                close();
+                break;
+            default:
+                return;
+            }
+            e.preventDefault();
+        });
+
+        // Swipe left/right
+        $viewer.on('touchstart', function(e) {
+            touchX = e.originalEvent.touches[0].clientX;
+        }).on('touchend', function(e) {
+            if (touchX === null) {
+                return;
+            }
+            var dx = e.originalEvent.changedTouches[0].clientX - touchX;
+            touchX = null;
+            if (Math.abs(dx) > 50) {
+                show(dx < 0 ? current + 1 : current - 1);
+            }
+        });
+    }
+
+    function open(i, slideshow) {
+        $viewer.prop('hidden', false).focus();
+        $('body').addClass('viewer-open');
+
+        // Only works from a click, deep links just get the overlay
+        var el = $viewer[0];
+        var request = el.requestFullscreen || el.webkitRequestFullscreen || el.mozRequestFullScreen;
+        if (request) {
+            try {
+                var p = request.call(el);
+                if (p && p.catch) {
+                    p.catch(function() {});
+                }
+            } catch (e) {}
+        }
+
+        show(i);
+        if (slideshow) {
+            toggleSlideshow();
+        }
+    }
+
+    function close() {
+        stopSlideshow();
+        current = -1;
+        $viewer.prop('hidden', true);
+        $media.empty();
+        $('body').removeClass('viewer-open');
+
+        var exit = document.exitFullscreen || document.webkitExitFullscreen || document.mozCancelFullScreen;
+        if (exit && (document.fullscreenElement || document.webkitFullscreenElement || document.mozFullScreenElement)) {
+            exit.call(document);
+        }
+
+        setHash('');
+    }
+
+    function show(i) {
+        // Wrap around, slideshows keep going
+        current = (i + items.length) % items.length;
+        var item = items[current];
+
+        $media.empty();
+        if (item.video) {
+            $('<video autoplay loop muted playsinline>').prop('muted', true).attr('src', item.video).appendTo($media);
+        } else {
+            $('<img>').attr({ src: item.src, alt: item.caption || item.title }).appendTo($media);
+        }
+
+        $caption.text(item.caption || item.title);
+        $counter.text((current + 1) + ' / ' + items.length);
+        setHash('image=' + encodeURIComponent(item.name));
+
+        // Preload the neighbours so moving is quick, slideshows only go forwards
+        preload(current + 1);
+        if (timer === null) {
+            preload(current - 1);
+        }
+
+        // Restart the timer so every image gets the full interval
+        if (timer !== null) {
+            stopSlideshow();
+            startSlideshow();
+        }
+    }
+
+    function preload(i) {
+        var item = items[(i + items.length) % items.length];
+        if (!item.video) {
+            (new Image()).src = item.src;
+        }
+    }
+
+    function toggleSlideshow() {
+        if (timer === null) {
+            startSlideshow();
+        } else {
+            stopSlideshow();
+        }
+    }
+
+    function startSlideshow() {
+        timer = setInterval(function() {
+            show(current + 1);
+        }, interval * 1000);
+        $play.html('&#10074;&#10074;').addClass('viewer-playing');
+    }
+
+    function stopSlideshow() {
+        clearInterval(timer);
+        timer = null;
+        $play.html('&#9654;').removeClass('viewer-playing');
+    }
+
+    function setHash(hash) {
+        var url = window.location.href.split('#')[0] + (hash ? '#' + hash : '');
+        if (window.history && history.replaceState) {
+            history.replaceState(null, '', url);
+        } else {
+            window.location.replace(url + (hash ? '' : '#'));
+        }
+    }
+
+    return { init: init };
+})();
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"sync"
 	"time"
 )
@@ -9,6 +10,7 @@ type GalleryData struct {
 	CacheUntil time.Time
 	Dirs       []string
 	Images     []ImageInfo
+	Meta       *FolderMeta
 }
 type GalleryCache struct {
 	*sync.Mutex
@@ -22,7 +24,7 @@ func NewGalleryCache() *GalleryCache {
 	}
 }
 
-func (gc *GalleryCache) Get(basePath string) ([]string, []ImageInfo, bool) {
+func (gc *GalleryCache) Get(basePath string) ([]string, []ImageInfo, *FolderMeta, bool) {
 	// Acquire lock
 	gc.Lock()
 	defer gc.Unlock()
@@ -30,19 +32,22 @@ func (gc *GalleryCache) Get(basePath string) ([]string, []ImageInfo, bool) {
 	// Check cache
 	gd, ok := gc.Paths[basePath]
 	if !ok {
-		return nil, nil, false
+		metricCacheMisses.Inc()
+		return nil, nil, nil, false
 	}
 
 	// Check expiration time
 	if gd.CacheUntil.Before(time.Now()) {
 		delete(gc.Paths, basePath)
-		return nil, nil, false
+		metricCacheMisses.Inc()
+		return nil, nil, nil, false
 	} else {
-		return gd.Dirs, gd.Images, true
+		metricCacheHits.Inc()
+		return gd.Dirs, gd.Images, gd.Meta, true
 	}
 }
 
-func (gc *GalleryCache) Set(basePath string, dirs []string, images []ImageInfo) {
+func (gc *GalleryCache) Set(basePath string, dirs []string, images []ImageInfo, meta *FolderMeta) {
 	// Acquire lock
 	gc.Lock()
 	defer gc.Unlock()
@@ -51,13 +56,55 @@ func (gc *GalleryCache) Set(basePath string, dirs []string, images []ImageInfo)
 		CacheUntil: time.Now().Add(time.Duration(Config.Global.CacheTime) * time.Second),
 		Dirs:       dirs,
 		Images:     images,
+		Meta:       meta,
 	}
 }
 
 func (gc *GalleryCache) Delete(basePath string) {
+	// Acquire lock
+	gc.Lock()
+	defer gc.Unlock()
+
 	delete(gc.Paths, basePath)
 }
 
+// Delete every path that is basePath or inside it
+func (gc *GalleryCache) DeletePrefix(basePath string) int {
+	// Acquire lock
+	gc.Lock()
+	defer gc.Unlock()
+
+	count := 0
+	for k := range gc.Paths {
+		if k == basePath || strings.HasPrefix(k, basePath+"/") {
+			delete(gc.Paths, k)
+			count++
+		}
+	}
+
+	return count
+}
+
+// Delete everything
+func (gc *GalleryCache) Flush() int {
+	// Acquire lock
+	gc.Lock()
+	defer gc.Unlock()
+
+	count := len(gc.Paths)
+	gc.Paths = make(map[string]GalleryData)
+
+	return count
+}
+
+func (gc *GalleryCache) Len() int {
+	// Acquire lock
+	gc.Lock()
+	defer gc.Unlock()
+
+	return len(gc.Paths)
+}
+
 func (gc *GalleryCache) Expire() {
 	// Acquire lock
 	gc.Lock()
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Don't queue the same folder for a cover more often than this
+	COVER_REQUEUE_TIME = time.Duration(10) * time.Minute
+	// Forget old queue entries once there are this many
+	COVER_QUEUE_PRUNE = 1000
+)
+
+var (
+	reCover = regexp.MustCompile("(?i)^(cover|folder)\\.(gif|jpeg|jpg|png)$")
+)
+
+// Folders waiting for CoverMaker
+var coverQueue = struct {
+	sync.Mutex
+	Queued map[string]time.Time
+}{
+	Queued: make(map[string]time.Time),
+}
+
+// Give folders that have never been visited a cover in the background
+func CoverMaker() chan FolderData {
+	c := make(chan FolderData, 1000)
+
+	go func() {
+		for fd := range c {
+			if err := makeCover(fd.Gallery, fd.BasePath); err != nil {
+				log.Warning("CoverMaker(%s): %s", fd.BasePath, err.Error())
+				continue
+			}
+
+			// Done, it won't be queued again now that it has a dirthumb
+			coverQueue.Lock()
+			delete(coverQueue.Queued, fd.BasePath)
+			coverQueue.Unlock()
+		}
+	}()
+
+	return c
+}
+
+// Queue a folder for CoverMaker, unless it was queued recently
+func queueCover(gallery *GalleryConfig, basePath string) {
+	coverQueue.Lock()
+	defer coverQueue.Unlock()
+
+	if t, ok := coverQueue.Queued[basePath]; ok && time.Since(t) < COVER_REQUEUE_TIME {
+		return
+	}
+
+	// Folders that failed hang around, clear out the old ones now and then
+	if len(coverQueue.Queued) >= COVER_QUEUE_PRUNE {
+		for p, t := range coverQueue.Queued {
+			if time.Since(t) >= COVER_REQUEUE_TIME {
+				delete(coverQueue.Queued, p)
+			}
+		}
+	}
+
+	select {
+	case cmChan <- FolderData{BasePath: basePath, Gallery: gallery}:
+		coverQueue.Queued[basePath] = time.Now()
+	default:
+		// Queue is full, try again next time
+	}
+}
+
+// Pick and save a cover for a folder without scanning the whole thing. If it has been
+// scanned the Redis data is enough, otherwise only the images that could be the cover are
+// thumbnailed. Folders without images get an empty dirthumb so they aren't queued again.
+func makeCover(gallery *GalleryConfig, basePath string) error {
+	// Get a Redis connection
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	meta := loadFolderMeta(basePath)
+
+	fileMap, err := getFileMap(conn, basePath)
+	if err != nil {
+		return err
+	}
+
+	var candidates []ImageInfo
+	if len(fileMap) > 0 {
+		var fileNames []string
+		for fileName := range fileMap {
+			fileNames = append(fileNames, fileName)
+		}
+		sort.Strings(fileNames)
+		for _, fileName := range fileNames {
+			candidates = append(candidates, fileMap[fileName])
+		}
+	} else {
+		if candidates, err = coverCandidates(gallery, meta, basePath); err != nil {
+			return err
+		}
+	}
+
+	coverPath, err := chooseCover(gallery, meta, candidates)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", "dirthumb", basePath, coverPath)
+	return err
+}
+
+// Peek at the file names in a folder and thumbnail the ones chooseCover would use
+func coverCandidates(gallery *GalleryConfig, meta *FolderMeta, basePath string) ([]ImageInfo, error) {
+	fileInfos, err := ioutil.ReadDir(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	relDir := gallery.relPath(basePath)
+	var images []os.FileInfo
+	for _, fi := range fileInfos {
+		if !reImage.MatchString(fi.Name()) || gallery.Excluded(path.Join(relDir, fi.Name()), false) {
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = gallery.statSymlink(path.Join(basePath, fi.Name())); err != nil {
+				continue
+			}
+		}
+		if fi.Mode().IsRegular() {
+			images = append(images, fi)
+		}
+	}
+	if len(images) == 0 {
+		return nil, nil
+	}
+
+	// Same choice chooseCover makes, but before there are any thumbnails
+	var picked []os.FileInfo
+	for _, fi := range images {
+		if fi.Name() == meta.Cover || reCover.MatchString(fi.Name()) {
+			picked = []os.FileInfo{fi}
+			break
+		}
+	}
+	if picked == nil {
+		switch gallery.CoverRule {
+		case "first":
+			picked = images[:1]
+		case "mosaic":
+			if len(images) < 4 {
+				picked = images[:1]
+			} else {
+				picked = images[:4]
+			}
+		default:
+			latest := images[0]
+			for _, fi := range images[1:] {
+				if fi.ModTime().After(latest.ModTime()) {
+					latest = fi
+				}
+			}
+			picked = []os.FileInfo{latest}
+		}
+	}
+
+	var candidates []ImageInfo
+	for _, fi := range picked {
+		filePath := path.Join(basePath, fi.Name())
+		b, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		thumbPart, out, err := makeThumbnail(gallery, filePath, b)
+		if err != nil {
+			log.Warning("coverCandidates convert failed: %q", out)
+			continue
+		}
+		candidates = append(candidates, ImageInfo{
+			ModTime:   fi.ModTime().Unix(),
+			ImagePath: path.Join(relDir, fi.Name()),
+			ThumbPath: thumbPart,
+		})
+	}
+
+	return candidates, nil
+}
+
+// Pick the cover for a folder using the gallery's CoverRule, returns the thumbnail path
+// relative to ThumbPath. An explicit cover (Cover in .gollery.conf, or an image named
+// cover.jpg/folder.jpg) always wins.
+func chooseCover(gallery *GalleryConfig, meta *FolderMeta, images []ImageInfo) (string, error) {
+	var usable []ImageInfo
+	for _, imageInfo := range images {
+		if !imageInfo.Broken && imageInfo.ThumbPath != "" {
+			usable = append(usable, imageInfo)
+		}
+	}
+	if len(usable) == 0 {
+		return "", nil
+	}
+
+	for _, imageInfo := range usable {
+		fileName := path.Base(imageInfo.ImagePath)
+		if fileName == meta.Cover || reCover.MatchString(fileName) {
+			return imageInfo.ThumbPath, nil
+		}
+	}
+
+	switch gallery.CoverRule {
+	case "first":
+		return usable[0].ThumbPath, nil
+
+	case "mosaic":
+		if len(usable) < 4 {
+			return usable[0].ThumbPath, nil
+		}
+		return makeMosaic(gallery, usable[:4])
+
+	default:
+		latest := usable[0]
+		for _, imageInfo := range usable[1:] {
+			if imageInfo.ModTime > latest.ModTime {
+				latest = imageInfo
+			}
+		}
+		return latest.ThumbPath, nil
+	}
+}
+
+// Make a 2x2 mosaic of four thumbnails, named after the thumbnails it contains
+func makeMosaic(gallery *GalleryConfig, images []ImageInfo) (string, error) {
+	h := md5.New()
+	for _, imageInfo := range images {
+		h.Write([]byte(imageInfo.ThumbPath))
+	}
+
+	thumbName := fmt.Sprintf("%x.jpg", h.Sum(nil))
+	thumbPart := path.Join(string(thumbName[0]), thumbName)
+	thumbPath := path.Join(gallery.ThumbPath, thumbPart)
+
+	// Already made it
+	if _, err := os.Stat(thumbPath); err == nil {
+		return thumbPart, nil
+	}
+
+	var t [4]string
+	for i, imageInfo := range images {
+		t[i] = path.Join(gallery.ThumbPath, imageInfo.ThumbPath)
+	}
+
+	out, err := runTool("convert",
+		"(", t[0], t[1], "+append", ")",
+		"(", t[2], t[3], "+append", ")",
+		"-append", "-resize", fmt.Sprintf("%dx%d!", gallery.ThumbWidth, gallery.ThumbHeight), "-quality", "90", thumbPath)
+	if err != nil {
+		return "", fmt.Errorf("mosaic failed: %q", out)
+	}
+
+	return thumbPart, nil
+}
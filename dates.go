@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Sorted set of image paths by EXIF date (or mtime), per gallery
+	DATES_KEY = "dates:%s"
+	// How long year and month listings are kept
+	DATES_CACHE_TIME = time.Duration(5) * time.Minute
+)
+
+type datesCacheEntry struct {
+	Dirs    []DirInfo
+	Updated time.Time
+}
+
+// Year (0 for the list of years) -> listing, per gallery
+var datesCache = struct {
+	sync.Mutex
+	Dirs map[string]map[int]datesCacheEntry
+}{
+	Dirs: make(map[string]map[int]datesCacheEntry),
+}
+
+// When an image was taken, or modified if the camera didn't say
+func imageDate(imageInfo ImageInfo) int64 {
+	if imageInfo.Taken != 0 {
+		return imageInfo.Taken
+	}
+	return imageInfo.ModTime
+}
+
+// Add a folder's new or changed images to the date index and drop the ones that have gone away
+func updateDates(conn redis.Conn, gallery *GalleryConfig, changed map[string]ImageInfo, removed []string) error {
+	key := fmt.Sprintf(DATES_KEY, gallery.ImagePath)
+
+	if len(removed) > 0 {
+		args := redis.Args{}.Add(key)
+		for _, imagePath := range removed {
+			args = args.Add(imagePath)
+		}
+		if _, err := conn.Do("ZREM", args...); err != nil {
+			return err
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	args := redis.Args{}.Add(key)
+	for _, imageInfo := range changed {
+		args = args.Add(imageDate(imageInfo), imageInfo.ImagePath)
+	}
+	_, err := conn.Do("ZADD", args...)
+	return err
+}
+
+// Serve /.dates/[YYYY/[MM/[DD/]]] as virtual folders
+func DatesHandler(w http.ResponseWriter, r *http.Request) {
+	// Check the gallery header
+	g := getGallery(r)
+	if g == "" {
+		http.NotFound(w, r)
+		return
+	}
+	gallery := Config.Gallery[g]
+
+	// Redirect to the trailing slash version so relative links work
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, gallery.BaseURL+strings.TrimPrefix(r.URL.Path, "/")+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	// Parse the date parts
+	var parts []int
+	for _, part := range strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/.dates"), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 1 || len(parts) >= 3 {
+			http.NotFound(w, r)
+			return
+		}
+		parts = append(parts, n)
+	}
+
+	// Get a Redis connection
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf(DATES_KEY, gallery.ImagePath)
+	crumbs := []Crumb{{Name: "Dates", Path: gallery.BaseURL + ".dates/"}}
+
+	var dirs []DirInfo
+	var images []ImageInfo
+	var title string
+	var err error
+
+	switch len(parts) {
+	case 0:
+		// Years, from the oldest to the newest image
+		title = "Dates"
+		dirs, err = dateDirs(conn, gallery, key, 0)
+
+	case 1:
+		// Months in a year
+		title = strconv.Itoa(parts[0])
+		crumbs = append(crumbs, Crumb{Name: title})
+		dirs, err = dateDirs(conn, gallery, key, parts[0])
+
+	case 2:
+		// Days in a month, plus all of the month's images
+		start := time.Date(parts[0], time.Month(parts[1]), 1, 0, 0, 0, 0, time.Local)
+		if start.Month() != time.Month(parts[1]) {
+			http.NotFound(w, r)
+			return
+		}
+		title = start.Format("January 2006")
+		crumbs = append(crumbs, Crumb{Name: start.Format("2006"), Path: gallery.BaseURL + start.Format(".dates/2006/")}, Crumb{Name: start.Format("January")})
+		if images, err = dateImages(conn, gallery, key, start, start.AddDate(0, 1, 0), 0); err == nil {
+			dirs = dayDirs(images)
+		}
+
+	case 3:
+		// Images on a day
+		start := time.Date(parts[0], time.Month(parts[1]), parts[2], 0, 0, 0, 0, time.Local)
+		if start.Month() != time.Month(parts[1]) || start.Day() != parts[2] {
+			http.NotFound(w, r)
+			return
+		}
+		title = start.Format("2 January 2006")
+		crumbs = append(crumbs, Crumb{Name: start.Format("2006"), Path: gallery.BaseURL + start.Format(".dates/2006/")},
+			Crumb{Name: start.Format("January"), Path: gallery.BaseURL + start.Format(".dates/2006/01/")}, Crumb{Name: start.Format("2")})
+		images, err = dateImages(conn, gallery, key, start, start.AddDate(0, 0, 1), 0)
+	}
+
+	if err != nil {
+		log.Error("DatesHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	p := virtualPage(g, gallery, title, r.URL.Path, crumbs)
+	p.Dirs = dirs
+	p.Images = images
+	renderTemplate(w, "gallery", g, p)
+}
+
+// The years with images, or the months with images in a year, from the cache if it's fresh
+// enough. Each populated one takes a query to find, empty ones are skipped over.
+func dateDirs(conn redis.Conn, gallery *GalleryConfig, key string, year int) ([]DirInfo, error) {
+	datesCache.Lock()
+	entry, ok := datesCache.Dirs[gallery.ImagePath][year]
+	datesCache.Unlock()
+	if ok && time.Since(entry.Updated) < DATES_CACHE_TIME {
+		return entry.Dirs, nil
+	}
+
+	// Don't hold the lock while talking to Redis, two requests building the same listing is fine
+
+	min, max := "-inf", "+inf"
+	if year > 0 {
+		min = strconv.FormatInt(time.Date(year, 1, 1, 0, 0, 0, 0, time.Local).Unix(), 10)
+		max = "(" + strconv.FormatInt(time.Date(year+1, 1, 1, 0, 0, 0, 0, time.Local).Unix(), 10)
+	}
+
+	var dirs []DirInfo
+	for {
+		t, err := firstDate(conn, key, min, max)
+		if err != nil {
+			return nil, err
+		} else if t.IsZero() {
+			break
+		}
+
+		var start, end time.Time
+		if year == 0 {
+			start = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.Local)
+			end = start.AddDate(1, 0, 0)
+			dirs, err = addDateDir(conn, gallery, key, dirs, start, end, start.Format("2006"), start.Format("2006"))
+		} else {
+			start = time.Date(year, t.Month(), 1, 0, 0, 0, 0, time.Local)
+			end = start.AddDate(0, 1, 0)
+			dirs, err = addDateDir(conn, gallery, key, dirs, start, end, start.Format("01"), start.Format("January"))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		min = strconv.FormatInt(end.Unix(), 10)
+	}
+
+	// Only keep listings with something in them, anyone can ask for any year
+	if len(dirs) > 0 {
+		datesCache.Lock()
+		if datesCache.Dirs[gallery.ImagePath] == nil {
+			datesCache.Dirs[gallery.ImagePath] = make(map[int]datesCacheEntry)
+		}
+		datesCache.Dirs[gallery.ImagePath][year] = datesCacheEntry{dirs, time.Now()}
+		datesCache.Unlock()
+	}
+
+	return dirs, nil
+}
+
+// Date of the first image with a score in [min, max], zero if there isn't one
+func firstDate(conn redis.Conn, key, min, max string) (time.Time, error) {
+	values, err := redis.Strings(conn.Do("ZRANGEBYSCORE", key, min, max, "WITHSCORES", "LIMIT", 0, 1))
+	if err != nil || len(values) < 2 {
+		return time.Time{}, err
+	}
+	score, err := strconv.ParseInt(values[1], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(score, 0), nil
+}
+
+// Forget the date listings for a gallery
+func forgetDates(gallery *GalleryConfig) {
+	datesCache.Lock()
+	defer datesCache.Unlock()
+
+	delete(datesCache.Dirs, gallery.ImagePath)
+}
+
+// Forget every date listing
+func flushDates() {
+	datesCache.Lock()
+	defer datesCache.Unlock()
+
+	datesCache.Dirs = make(map[string]map[int]datesCacheEntry)
+}
+
+// Images dated in [start, end), oldest first. A limit of 0 means all of them.
+func dateImages(conn redis.Conn, gallery *GalleryConfig, key string, start, end time.Time, limit int) ([]ImageInfo, error) {
+	args := redis.Args{}.Add(key, start.Unix(), "("+strconv.FormatInt(end.Unix(), 10))
+	if limit > 0 {
+		args = args.Add("LIMIT", 0, limit)
+	}
+	imagePaths, err := redis.Strings(conn.Do("ZRANGEBYSCORE", args...))
+	if err != nil {
+		return nil, err
+	}
+	return lookupImages(conn, gallery, imagePaths)
+}
+
+// Add a dir for [start, end) if it has any images, using the first one as the cover
+func addDateDir(conn redis.Conn, gallery *GalleryConfig, key string, dirs []DirInfo, start, end time.Time, dirPath, dirName string) ([]DirInfo, error) {
+	// A few images might be hidden, look a little further for a cover
+	images, err := dateImages(conn, gallery, key, start, end, 10)
+	if err != nil || len(images) == 0 {
+		return dirs, err
+	}
+	return append(dirs, DirInfo{dirPath, dirName, ".thumbs/" + images[0].ThumbPath}), nil
+}
+
+// Group a month's images into days
+func dayDirs(images []ImageInfo) []DirInfo {
+	var dirs []DirInfo
+	for _, imageInfo := range images {
+		t := time.Unix(imageDate(imageInfo), 0)
+		day := t.Format("02")
+		if len(dirs) == 0 || dirs[len(dirs)-1].Path != day {
+			dirs = append(dirs, DirInfo{day, t.Format("Mon 2"), ".thumbs/" + imageInfo.ThumbPath})
+		}
+	}
+	return dirs
+}
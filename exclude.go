@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// Folders containing this file are hidden, along with everything below them
+	IGNORE_FILE = ".gollery-ignore"
+)
+
+// Should a single file or folder be hidden? relPath is relative to ImagePath. Parent
+// folders aren't checked, use PathExcluded for that.
+func (g *GalleryConfig) Excluded(relPath string, isDir bool) bool {
+	name := path.Base(relPath)
+
+	// Dotfiles and dotdirectories are always hidden
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+
+	if isDir {
+		if matchAny(g.ExcludeDir, name, relPath) {
+			return true
+		}
+		if len(g.IncludeDir) > 0 && !g.includedDir(relPath) {
+			return true
+		}
+		if _, err := os.Stat(path.Join(g.ImagePath, relPath, IGNORE_FILE)); err == nil {
+			return true
+		}
+		return false
+	}
+
+	if matchAny(g.ExcludeFile, name, relPath) {
+		return true
+	}
+	if len(g.IncludeFile) > 0 && !matchAny(g.IncludeFile, name, relPath) {
+		return true
+	}
+	return false
+}
+
+// Is anything along a path hidden? Handlers use this to refuse requests for excluded
+// files, not just hide them from listings.
+func (g *GalleryConfig) PathExcluded(relPath string, isDir bool) bool {
+	relPath = strings.Trim(relPath, "/")
+	if relPath == "" || relPath == "." {
+		return false
+	}
+
+	parts := strings.Split(relPath, "/")
+	for i := range parts {
+		last := i == len(parts)-1
+		if g.Excluded(strings.Join(parts[:i+1], "/"), !last || isDir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A folder is included if it or any of its parents match IncludeDir
+func (g *GalleryConfig) includedDir(relPath string) bool {
+	parts := strings.Split(relPath, "/")
+	for i := range parts {
+		if matchAny(g.IncludeDir, parts[i], strings.Join(parts[:i+1], "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Does any glob pattern match the name or gallery relative path?
+func matchAny(patterns []string, name, relPath string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, relPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Path of a folder or file relative to the gallery's ImagePath, "" for the root
+func (g *GalleryConfig) relPath(fullPath string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(fullPath, g.ImagePath), "/")
+}
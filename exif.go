@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rwcarlsen/goexif/exif"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Image pages remember this many EXIF summaries
+	EXIF_CACHE_MAX = 1000
+)
+
+type exifCacheEntry struct {
+	ModTime int64
+	Size    int64
+	Exif    *ExifInfo
+}
+
+var exifCache = struct {
+	sync.Mutex
+	Paths map[string]exifCacheEntry
+}{
+	Paths: make(map[string]exifCacheEntry),
+}
+
+// The EXIF bits worth showing. GPS is left out on purpose, people don't expect a
+// gallery to publish where their photos were taken.
+type ExifInfo struct {
+	Camera      string
+	Lens        string
+	Taken       time.Time
+	Exposure    string
+	Aperture    string
+	ISO         string
+	FocalLength string
+}
+
+// When a photo was taken, from the file data. Zero if we can't tell.
+func exifTaken(b []byte) int64 {
+	x, err := exif.Decode(bytes.NewReader(b))
+	if err != nil {
+		return 0
+	}
+
+	t, err := x.DateTime()
+	if err != nil {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// readExif for image pages, remembered until the file changes so views don't decode
+// the original every time
+func cachedExif(filePath string) (*ExifInfo, error) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	exifCache.Lock()
+	entry, ok := exifCache.Paths[filePath]
+	exifCache.Unlock()
+	if ok && entry.ModTime == fi.ModTime().UnixNano() && entry.Size == fi.Size() {
+		return entry.Exif, nil
+	}
+
+	// Missing EXIF is remembered too, it's the usual case for anything but JPEGs
+	info, err := readExif(filePath)
+	if err != nil && os.IsNotExist(err) {
+		return nil, err
+	}
+
+	exifCache.Lock()
+	defer exifCache.Unlock()
+	if len(exifCache.Paths) >= EXIF_CACHE_MAX {
+		exifCache.Paths = make(map[string]exifCacheEntry)
+	}
+	exifCache.Paths[filePath] = exifCacheEntry{fi.ModTime().UnixNano(), fi.Size(), info}
+
+	return info, err
+}
+
+// Read EXIF data from an image, only JPEGs (and TIFFs) have it
+func readExif(filePath string) (*ExifInfo, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	x, err := exif.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ExifInfo{
+		Lens: exifString(x, exif.LensModel),
+	}
+
+	// Models usually include the make, "Canon Canon EOS 5D" is silly
+	maker, model := exifString(x, exif.Make), exifString(x, exif.Model)
+	if strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		info.Camera = model
+	} else {
+		info.Camera = strings.TrimSpace(maker + " " + model)
+	}
+
+	if t, err := x.DateTime(); err == nil {
+		info.Taken = t
+	}
+
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && num > 0 && den > 0 {
+			if num < den {
+				info.Exposure = fmt.Sprintf("1/%.0f s", float64(den)/float64(num))
+			} else {
+				info.Exposure = fmt.Sprintf("%.1f s", float64(num)/float64(den))
+			}
+		}
+	}
+
+	if tag, err := x.Get(exif.FNumber); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && den > 0 {
+			info.Aperture = fmt.Sprintf("f/%.1f", float64(num)/float64(den))
+		}
+	}
+
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		if iso, err := tag.Int(0); err == nil {
+			info.ISO = fmt.Sprintf("%d", iso)
+		}
+	}
+
+	if tag, err := x.Get(exif.FocalLength); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && den > 0 {
+			info.FocalLength = fmt.Sprintf("%.0f mm", float64(num)/float64(den))
+		}
+	}
+
+	return info, nil
+}
+
+// Get a string tag, "" if it's missing
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
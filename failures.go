@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+const (
+	FAILED_CONVERT = "failed:convert"
+	FAILED_FFMPEG  = "failed:ffmpeg"
+)
+
+// Information about a file that could not be converted
+type FailureInfo struct {
+	FileSize    int64  `json:"size"`
+	ModTime     int64  `json:"mtime"`
+	Output      string `json:"output"`
+	Attempts    int    `json:"attempts"`
+	LastAttempt int64  `json:"last"`
+}
+
+// Returns true if the file has not changed since it failed
+func (f *FailureInfo) Matches(fileSize, modTime int64) bool {
+	return f != nil && f.FileSize == fileSize && f.ModTime == modTime
+}
+
+// Fetch the failure record for a file, nil if there isn't one
+func getFailure(conn redis.Conn, key, filePath string) (*FailureInfo, error) {
+	jsonData, err := redis.String(conn.Do("HGET", key, filePath))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var failure FailureInfo
+	if err = json.Unmarshal([]byte(jsonData), &failure); err != nil {
+		return nil, err
+	}
+
+	return &failure, nil
+}
+
+// Save a failure record for a file, bumping the attempt count
+func recordFailure(conn redis.Conn, key, filePath string, fileSize, modTime int64, output string) error {
+	failure, err := getFailure(conn, key, filePath)
+	if err != nil {
+		return err
+	}
+	if failure == nil {
+		failure = &FailureInfo{}
+	}
+
+	failure.FileSize = fileSize
+	failure.ModTime = modTime
+	failure.Output = output
+	failure.Attempts++
+	failure.LastAttempt = time.Now().Unix()
+
+	b, err := json.Marshal(failure)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", key, filePath, string(b))
+	return err
+}
+
+// Remove the failure record for a file
+func clearFailure(conn redis.Conn, key, filePath string) error {
+	_, err := conn.Do("HDEL", key, filePath)
+	return err
+}
+
+// Fetch every failure record for a key
+func getFailures(conn redis.Conn, key string) (map[string]FailureInfo, error) {
+	failures := make(map[string]FailureInfo)
+
+	results, err := redis.Strings(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i+1 < len(results); i += 2 {
+		var failure FailureInfo
+		if err = json.Unmarshal([]byte(results[i+1]), &failure); err != nil {
+			return nil, err
+		}
+		failures[results[i]] = failure
+	}
+
+	return failures, nil
+}
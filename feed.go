@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Sorted set of image paths by feed time, per gallery. It isn't trimmed like the recent
+	// index, folder feeds need to reach back to whenever that folder was last touched.
+	FEED_KEY        = "feed:%s"
+	FEED_CACHE_TIME = time.Duration(5) * time.Minute
+	FEED_ENTRIES    = 50
+	// Index entries read at a time while looking for images under a folder
+	FEED_BATCH = 500
+
+	// Sort feeds by file modification time or EXIF capture time
+	FEED_SORT_MTIME = "mtime"
+	FEED_SORT_TAKEN = "taken"
+)
+
+var feedSummary = template.Must(template.New("summary").Parse(
+	`<p><a href="{{.PageURL}}"><img src="{{.ThumbURL}}" alt="{{.Title}}"></a></p>{{if .Caption}}<p>{{.Caption}}</p>{{end}}`))
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Links   []atomLink `xml:"link"`
+	Summary atomText   `xml:"summary"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// An image for a feed, with the time it's sorted by
+type feedImage struct {
+	ImageInfo
+	Time int64
+}
+
+// Feeds for deep folders can walk a lot of the index, so keep them around for a while
+var feedCache = struct {
+	sync.Mutex
+	Images  map[string][]feedImage
+	Updated map[string]time.Time
+}{
+	Images:  make(map[string][]feedImage),
+	Updated: make(map[string]time.Time),
+}
+
+// Serve an Atom feed of the newest images in a folder and everything under it
+func FeedHandler(w http.ResponseWriter, r *http.Request) {
+	// Check the gallery header
+	g := getGallery(r)
+	if g == "" {
+		http.NotFound(w, r)
+		return
+	}
+	gallery := Config.Gallery[g]
+
+	// Check path
+	folderPath, err := gallery.resolveImagePath(r.URL.Path)
+	if err != nil || gallery.PathExcluded(gallery.relPath(folderPath), true) {
+		http.NotFound(w, r)
+		return
+	}
+	if fi, err := os.Stat(folderPath); err != nil || !fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	images, err := getFeedImages(gallery, folderPath)
+	if err != nil {
+		log.Error("FeedHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	folderURL := strings.TrimSuffix(strings.TrimPrefix(path.Clean(r.URL.Path), "/"), "/")
+	if folderURL != "" {
+		folderURL += "/"
+	}
+
+	title := gallery.Name
+	if folderURL != "" {
+		title = fmt.Sprintf("%s - %s", gallery.Name, strings.Replace(strings.TrimSuffix(folderURL, "/"), "_", " ", -1))
+	}
+
+	feed := &atomFeed{
+		ID:     absoluteURL(r, gallery, ".feed/"+folderURL),
+		Title:  title,
+		Author: gallery.Name,
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: absoluteURL(r, gallery, ".feed/"+folderURL)},
+			{Rel: "alternate", Type: "text/html", Href: absoluteURL(r, gallery, folderURL)},
+		},
+		Updated: time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(images) > 0 {
+		feed.Updated = time.Unix(images[0].Time, 0).UTC().Format(time.RFC3339)
+	}
+
+	for _, image := range images {
+		pageURL := absoluteURL(r, gallery, image.ImagePath+".html")
+		thumbURL := absoluteURL(r, gallery, ".thumbs/"+image.ThumbPath)
+
+		var summary strings.Builder
+		feedSummary.Execute(&summary, map[string]string{
+			"PageURL":  pageURL,
+			"ThumbURL": thumbURL,
+			"Title":    image.ImageTitle,
+			"Caption":  image.Caption,
+		})
+
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      pageURL,
+			Title:   image.ImageTitle,
+			Updated: time.Unix(image.Time, 0).UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "alternate", Type: "text/html", Href: pageURL},
+				{Rel: "related", Type: "text/html", Href: absoluteURL(r, gallery, imageFolder(image.ImagePath))},
+				{Rel: "enclosure", Type: "image/jpeg", Href: thumbURL},
+			},
+			Summary: atomText{Type: "html", Body: summary.String()},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		log.Error("FeedHandler: %s", err.Error())
+	}
+}
+
+// Get the newest images in a folder subtree, from the cache if it's fresh enough
+func getFeedImages(gallery *GalleryConfig, folderPath string) ([]feedImage, error) {
+	feedCache.Lock()
+	defer feedCache.Unlock()
+
+	images, ok := feedCache.Images[folderPath]
+	if ok && time.Since(feedCache.Updated[folderPath]) < FEED_CACHE_TIME {
+		return images, nil
+	}
+
+	// Get a Redis connection
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	images, err := scanFeedImages(conn, gallery, folderPath)
+	if err != nil {
+		return nil, err
+	}
+
+	feedCache.Images[folderPath] = images
+	feedCache.Updated[folderPath] = time.Now()
+
+	return images, nil
+}
+
+// Walk the feed index newest first, keeping the images under folderPath. Only folders that
+// have been scanned show up, that's what people have looked at anyway.
+func scanFeedImages(conn redis.Conn, gallery *GalleryConfig, folderPath string) ([]feedImage, error) {
+	key := fmt.Sprintf(FEED_KEY, gallery.ImagePath)
+	prefix := gallery.relPath(folderPath)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	fileMaps := make(map[string]map[string]ImageInfo)
+	metas := make(map[string]*FolderMeta)
+
+	var images []feedImage
+	for start := 0; len(images) < FEED_ENTRIES; start += FEED_BATCH {
+		values, err := redis.Strings(conn.Do("ZREVRANGE", key, start, start+FEED_BATCH-1, "WITHSCORES"))
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i+1 < len(values) && len(images) < FEED_ENTRIES; i += 2 {
+			imagePath := values[i]
+			if !strings.HasPrefix(imagePath, prefix) || gallery.PathExcluded(imagePath, false) {
+				continue
+			}
+
+			dir := path.Dir(imagePath)
+			fileMap, ok := fileMaps[dir]
+			if !ok {
+				dirPath := path.Join(gallery.ImagePath, dir)
+				if fileMap, err = getFileMap(conn, dirPath); err != nil {
+					return nil, err
+				}
+				fileMaps[dir] = fileMap
+				metas[dir] = loadFolderMeta(dirPath)
+			}
+
+			imageInfo, ok := fileMap[path.Base(imagePath)]
+			if !ok || imageInfo.ThumbPath == "" {
+				continue
+			}
+			t, err := strconv.ParseInt(values[i+1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+
+			// Captions aren't stored in Redis
+			imageInfo.applyCaption(metas[dir])
+			images = append(images, feedImage{imageInfo, t})
+		}
+
+		if len(values) < 2*FEED_BATCH {
+			break
+		}
+	}
+
+	return images, nil
+}
+
+// Add a folder's images to the feed index and drop the ones that have gone away
+func updateFeed(conn redis.Conn, gallery *GalleryConfig, changed map[string]ImageInfo, removed []string) error {
+	key := fmt.Sprintf(FEED_KEY, gallery.ImagePath)
+
+	if len(removed) > 0 {
+		args := redis.Args{}.Add(key)
+		for _, imagePath := range removed {
+			args = args.Add(imagePath)
+		}
+		if _, err := conn.Do("ZREM", args...); err != nil {
+			return err
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	args := redis.Args{}.Add(key)
+	for _, imageInfo := range changed {
+		args = args.Add(feedTime(gallery, imageInfo), imageInfo.ImagePath)
+	}
+	_, err := conn.Do("ZADD", args...)
+	return err
+}
+
+// The time an image is sorted by in feeds
+func feedTime(gallery *GalleryConfig, imageInfo ImageInfo) int64 {
+	if gallery.FeedSort == FEED_SORT_TAKEN && imageInfo.Taken != 0 {
+		return imageInfo.Taken
+	}
+	return imageInfo.ModTime
+}
+
+// URL path of the folder an image is in, relative to BaseURL
+func imageFolder(imagePath string) string {
+	dir := path.Dir(imagePath)
+	if dir == "." {
+		return ""
+	}
+	return dir + "/"
+}
+
+// Call fn for every field in a hash that starts with prefix
+func hscanPrefix(conn redis.Conn, key, prefix string, fn func(field, value string) error) error {
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("HSCAN", key, cursor, "MATCH", redisGlobEscape(prefix)+"*", "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+
+		if cursor, err = redis.Int(values[0], nil); err != nil {
+			return err
+		}
+		pairs, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if err = fn(pairs[i], pairs[i+1]); err != nil {
+				return err
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// Escape the special characters in a Redis glob pattern
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -17,15 +17,6 @@ const (
 	TIME_FORMAT = "2006-01-02 15:04:05"
 )
 
-func init() {
-	tmpl["gallery"] = template.Must(template.New("gallery").
-		Funcs(template.FuncMap{
-		"formatSize": formatSize,
-		"formatTime": formatTime,
-	}).
-		ParseFiles("assets/templates/gallery.html", "assets/templates/base.html"))
-}
-
 type DirInfo struct {
 	Path      string
 	Name      string
@@ -33,27 +24,27 @@ type DirInfo struct {
 }
 
 type Page struct {
-	BaseURL      string
-	JSON         string
-	Name         string
-	Path         string
-	StaticFolder string
-	StaticCSS    string
-	StaticJS     string
-	Dirs         []DirInfo
-	Images       []ImageInfo
-}
-
-func galleryStaticHandler(w http.ResponseWriter, r *http.Request, basePath string) {
-	// Check path
-	cleanPath := path.Clean(path.Join(basePath, r.URL.Path))
-	if !strings.HasPrefix(cleanPath, basePath) {
-		http.NotFound(w, r)
-		return
-	}
-
-	// Serve it
-	noDirFileServer(http.FileServer(http.Dir(basePath))).ServeHTTP(w, r)
+	BaseURL           string
+	JSON              string
+	Name              string
+	Path              string
+	Title             string
+	Description       string
+	StaticBroken      string
+	StaticFolder      string
+	StaticCSS         string
+	StaticJS          string
+	ThemeCSS          []string
+	Crumbs            []Crumb
+	FolderTree        bool
+	SlideshowInterval int
+	// Not a real folder, no uploads/ZIPs/feeds
+	Virtual bool
+	Upload  bool
+	Dirs    []DirInfo
+	Images  []ImageInfo
+	// Search box contents
+	Query string
 }
 
 // Serve static images for galleries
@@ -66,7 +57,13 @@ func ImageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	gallery := Config.Gallery[g]
 
-	galleryStaticHandler(w, r, gallery.ImagePath)
+	// Excluded files are off limits, not just hidden
+	if gallery.PathExcluded(path.Clean(r.URL.Path), false) {
+		http.NotFound(w, r)
+		return
+	}
+
+	galleryStaticHandler(w, r, gallery, staticRoot{gallery.ImagePath, gallery.ImageCacheControl, gallery.OffloadImageURL, gallery.imageContent})
 }
 
 // Serve static thumbnails for galleries
@@ -79,7 +76,7 @@ func ThumbHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	gallery := Config.Gallery[g]
 
-	galleryStaticHandler(w, r, gallery.ThumbPath)
+	galleryStaticHandler(w, r, gallery, staticRoot{gallery.ThumbPath, gallery.ThumbCacheControl, gallery.OffloadThumbURL, contentAddressed})
 }
 
 // Serve static videos for galleries
@@ -97,7 +94,7 @@ func VideoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	galleryStaticHandler(w, r, gallery.VideoPath)
+	galleryStaticHandler(w, r, gallery, staticRoot{gallery.VideoPath, gallery.VideoCacheControl, gallery.OffloadVideoURL, contentAddressed})
 }
 
 // Serve a gallery page
@@ -110,6 +107,12 @@ func GalleryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	gallery := Config.Gallery[g]
 
+	// Image pages look like /folder/IMG_0001.jpg.html
+	if strings.HasSuffix(r.URL.Path, ".html") && reImage.MatchString(strings.TrimSuffix(path.Base(r.URL.Path), ".html")) {
+		ImagePageHandler(w, r, g, gallery)
+		return
+	}
+
 	// Check for trailing /
 	if !strings.HasSuffix(r.URL.Path, "/") {
 		newPath := path.Clean(gallery.BaseURL+r.URL.Path) + "/"
@@ -119,14 +122,14 @@ func GalleryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check path
-	cleanPath := path.Clean(path.Join(gallery.ImagePath, r.URL.Path))
-	if !strings.HasPrefix(cleanPath, gallery.ImagePath) {
+	cleanPath, err := gallery.resolveImagePath(r.URL.Path)
+	if err != nil || gallery.PathExcluded(gallery.relPath(cleanPath), true) {
 		http.NotFound(w, r)
 		return
 	}
 
 	// Scan the directory
-	dirs, images, err := tn.ScanFolder(gallery, cleanPath)
+	dirs, images, meta, err := tn.ScanFolder(gallery, cleanPath)
 	if os.IsNotExist(err) {
 		http.NotFound(w, r)
 		return
@@ -151,6 +154,11 @@ func GalleryHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Never been scanned? Queue it up so it gets a cover next time.
+		if dirPath != ".." && err == redis.ErrNil {
+			queueCover(gallery, path.Join(cleanPath, dirPath))
+		}
+
 		// Placeholder thumbPath?
 		if dirPath == ".." || thumbPath == "" {
 			thumbPath = ".static/" + staticFiles["folder.png"]
@@ -158,9 +166,15 @@ func GalleryHandler(w http.ResponseWriter, r *http.Request) {
 			thumbPath = ".thumbs/" + thumbPath
 		}
 
+		// Use the folder title if it has one
+		dirName, ok := meta.DirTitles[dirPath]
+		if !ok {
+			dirName = strings.Replace(dirPath, "_", " ", -1)
+		}
+
 		dirinfos = append(dirinfos, DirInfo{
 			dirPath,
-			strings.Replace(dirPath, "_", " ", -1),
+			dirName,
 			thumbPath,
 		})
 	}
@@ -204,21 +218,45 @@ func GalleryHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Render the page
 	p := &Page{
-		BaseURL:      gallery.BaseURL,
-		Name:         gallery.Name,
-		Path:         r.URL.Path,
-		StaticCSS:    staticFiles["gollery.min.css"],
-		StaticFolder: staticFiles["folder.png"],
-		StaticJS:     staticFiles["gollery.min.js"],
-		Dirs:         dirinfos,
-		Images:       images,
-	}
-	renderTemplate(w, "gallery", p)
+		BaseURL:           gallery.BaseURL,
+		Name:              gallery.Name,
+		Path:              r.URL.Path,
+		Title:             meta.Title,
+		Description:       meta.Description,
+		StaticBroken:      staticFiles["broken.png"],
+		StaticCSS:         staticFiles["gollery.min.css"],
+		StaticFolder:      staticFiles["folder.png"],
+		StaticJS:          staticFiles["gollery.min.js"],
+		ThemeCSS:          themeCSS[g],
+		Crumbs:            getCrumbs(gallery, r.URL.Path),
+		FolderTree:        gallery.FolderTree,
+		SlideshowInterval: gallery.SlideshowInterval,
+		Upload:            gallery.Upload,
+		Dirs:              dirinfos,
+		Images:            images,
+	}
+	renderTemplate(w, "gallery", g, p)
 }
 
-// Render a template
-func renderTemplate(w http.ResponseWriter, t string, p *Page) {
-	err := tmpl[t].ExecuteTemplate(w, "base", p)
+// Render a template, using the gallery's theme if it has one
+func renderTemplate(w http.ResponseWriter, t string, g string, p interface{}) {
+	tp, err := getTemplate(t, g)
+	if err != nil {
+		log.Error("renderTemplate(%s): %s", t, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Our pages don't use inline scripts or styles, so a strict policy is fine
+	csp := Config.Global.ContentSecurityPolicy
+	if gallery, ok := Config.Gallery[g]; ok {
+		csp = gallery.ContentSecurityPolicy
+	}
+	if csp != "" {
+		w.Header().Set("Content-Security-Policy", csp)
+	}
+
+	err = tp.ExecuteTemplate(w, "base", p)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -249,3 +287,11 @@ func formatSize(size int64) string {
 func formatTime(unix int64) string {
 	return time.Unix(unix, 0).Format(TIME_FORMAT)
 }
+
+// Simple pipeline func to show a 0-5 rating as stars
+func formatRating(rating int) string {
+	if rating < 0 || rating > 5 {
+		return ""
+	}
+	return strings.Repeat("\u2605", rating) + strings.Repeat("\u2606", 5-rating)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+)
+
+// Liveness check, if we can answer at all we're alive
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// Readiness check, make sure everything we depend on is usable. This is public so it only
+// says ok/fail, the details are logged and on the admin listener's /readyz.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	problems := readinessProblems()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Warning("readyz: %s", problem)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "fail")
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// Readiness check with the list of problems, for the admin listener
+func AdminReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	problems := readinessProblems()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, problem := range problems {
+			fmt.Fprintln(w, problem)
+		}
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// Everything that's stopping us from being ready
+func readinessProblems() []string {
+	var problems []string
+
+	// Redis
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		problems = append(problems, fmt.Sprintf("redis: %s", err))
+	}
+
+	// Gallery paths, sorted so the output is stable
+	var names []string
+	for name := range Config.Gallery {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	needFFmpeg := false
+	for _, name := range names {
+		gallery := Config.Gallery[name]
+
+		if err := checkWritable(gallery.ThumbPath); err != nil {
+			problems = append(problems, fmt.Sprintf("gallery %s: ThumbPath: %s", name, err))
+		}
+		if gallery.VideoPath != "" {
+			needFFmpeg = true
+			if err := checkWritable(gallery.VideoPath); err != nil {
+				problems = append(problems, fmt.Sprintf("gallery %s: VideoPath: %s", name, err))
+			}
+		}
+	}
+
+	// External tools
+	if _, err := exec.LookPath("convert"); err != nil {
+		problems = append(problems, fmt.Sprintf("convert: %s", err))
+	}
+	if needFFmpeg {
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			problems = append(problems, fmt.Sprintf("ffmpeg: %s", err))
+		}
+	}
+
+	return problems
+}
+
+// Check that we can create files in a directory
+func checkWritable(dirPath string) error {
+	f, err := ioutil.TempFile(dirPath, ".gollery-readyz-")
+	if err != nil {
+		return err
+	}
+
+	name := f.Name()
+	f.Close()
+
+	return os.Remove(name)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type ImagePage struct {
+	BaseURL      string
+	Name         string
+	Path         string
+	Title        string
+	StaticBroken string
+	StaticCSS    string
+	StaticJS     string
+	ThemeCSS     []string
+	Crumbs       []Crumb
+	FileName     string
+	Image        ImageInfo
+	Exif         *ExifInfo
+	Tags         []TagLink
+	Prev         *ImageInfo
+	Next         *ImageInfo
+	// Absolute URLs for OpenGraph/Twitter tags
+	PageURL     string
+	ThumbURL    string
+	ThumbWidth  int
+	ThumbHeight int
+}
+
+// Serve a page for a single image, /folder/IMG_0001.jpg.html
+func ImagePageHandler(w http.ResponseWriter, r *http.Request, g string, gallery *GalleryConfig) {
+	imagePart := strings.TrimPrefix(strings.TrimSuffix(path.Clean(r.URL.Path), ".html"), "/")
+	folderURL := path.Dir("/" + imagePart)
+
+	// Check path
+	folderPath, err := gallery.resolveImagePath(folderURL)
+	if err != nil || gallery.PathExcluded(gallery.relPath(folderPath), true) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The folder data has everything we need, and it's probably cached
+	_, images, meta, err := tn.ScanFolder(gallery, folderPath)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Error("ImagePageHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	index := -1
+	for i := range images {
+		if images[i].ImagePath == imagePart {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	image := images[index]
+	fileName := path.Base(imagePart)
+
+	crumbs := getCrumbs(gallery, folderURL)
+	crumbs[len(crumbs)-1].Current = false
+	crumbs = append(crumbs, Crumb{Name: image.ImageTitle, Current: true})
+
+	p := &ImagePage{
+		BaseURL:      gallery.BaseURL,
+		Name:         gallery.Name,
+		Path:         strings.TrimSuffix(folderURL, "/") + "/",
+		Title:        meta.Title,
+		StaticBroken: staticFiles["broken.png"],
+		StaticCSS:    staticFiles["gollery.min.css"],
+		StaticJS:     staticFiles["gollery.min.js"],
+		ThemeCSS:     themeCSS[g],
+		Crumbs:       crumbs,
+		FileName:     fileName,
+		Image:        image,
+		PageURL:      absoluteURL(r, gallery, imagePart+".html"),
+		ThumbWidth:   gallery.ThumbWidth,
+		ThumbHeight:  gallery.ThumbHeight,
+	}
+	if index > 0 {
+		p.Prev = &images[index-1]
+	}
+	if index < len(images)-1 {
+		p.Next = &images[index+1]
+	}
+
+	if image.Broken {
+		p.ThumbURL = absoluteURL(r, gallery, ".static/"+staticFiles["broken.png"])
+	} else {
+		p.ThumbURL = absoluteURL(r, gallery, ".thumbs/"+image.ThumbPath)
+
+		// Not having EXIF data is perfectly normal
+		p.Exif, _ = cachedExif(filepath.Join(folderPath, fileName))
+	}
+
+	// Tags are nice to have, the page works without them
+	conn := redisPool.Get()
+	defer conn.Close()
+	if tags, err := getTags(conn, gallery, imagePart); err != nil {
+		log.Warning("ImagePageHandler tags: %s", err.Error())
+	} else {
+		p.Tags = tagLinks(gallery, tags)
+	}
+
+	renderTemplate(w, "image", g, p)
+}
+
+// Absolute URL for a path under BaseURL. PublicURL wins, otherwise guess from the request,
+// nginx needs to pass Host and X-Forwarded-Proto for that to work.
+func absoluteURL(r *http.Request, gallery *GalleryConfig, p string) string {
+	if gallery.PublicURL != "" {
+		u := &url.URL{Path: p}
+		return strings.TrimSuffix(gallery.PublicURL, "/") + "/" + u.EscapedPath()
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	u := &url.URL{
+		Scheme: scheme,
+		Host:   r.Host,
+		Path:   path.Join(gallery.BaseURL, p),
+	}
+	// Join eats the trailing / of folders
+	if p == "" || strings.HasSuffix(p, "/") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	}
+	return u.String()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"log/syslog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	LOG_TEXT_FORMAT = " %{level: -8s}  %{message}"
+)
+
+// Where access logs in combined/json format get written
+var logWriter io.Writer = os.Stdout
+
+// A log file that can be reopened after it has been rotated
+type reopenFile struct {
+	sync.Mutex
+	path string
+	file *os.File
+}
+
+func newReopenFile(path string) (*reopenFile, error) {
+	f := &reopenFile{path: path}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *reopenFile) Reopen() error {
+	f.Lock()
+	defer f.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+
+	return nil
+}
+
+func (f *reopenFile) Write(b []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.file.Write(b)
+}
+
+// Formats application log records as JSON lines
+type jsonFormatter struct{}
+
+func (jf jsonFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	b, err := json.Marshal(map[string]string{
+		"time":    r.Time.Format(time.RFC3339),
+		"level":   r.Level.String(),
+		"message": r.Message(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// Set up logging from the [Log] config section
+func SetupLogging() error {
+	// Defaults
+	if Config.Log.Level == "" {
+		Config.Log.Level = "INFO"
+	}
+	if Config.Log.Output == "" {
+		Config.Log.Output = "stdout"
+	}
+	if Config.Log.Format == "" {
+		Config.Log.Format = "text"
+	}
+
+	level, err := logging.LogLevel(Config.Log.Level)
+	if err != nil {
+		return err
+	}
+
+	// Formatter
+	switch Config.Log.Format {
+	case "text", "combined":
+		logging.SetFormatter(logging.MustStringFormatter(LOG_TEXT_FORMAT))
+	case "json":
+		logging.SetFormatter(jsonFormatter{})
+	default:
+		return fmt.Errorf("unknown log format: %s", Config.Log.Format)
+	}
+
+	// Backend
+	var backend logging.Backend
+	switch Config.Log.Output {
+	case "stdout":
+		logWriter = os.Stdout
+		backend = logging.NewLogBackend(logWriter, "", 0)
+
+	case "file":
+		f, err := newReopenFile(Config.Log.File)
+		if err != nil {
+			return err
+		}
+		logWriter = f
+		backend = logging.NewLogBackend(logWriter, "", 0)
+
+		// Reopen the log file on SIGHUP for logrotate and friends
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		go func() {
+			for _ = range c {
+				if err := f.Reopen(); err != nil {
+					log.Error("Unable to reopen log file: %s", err)
+				} else {
+					log.Info("Reopened log file %s", f.path)
+				}
+			}
+		}()
+
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "gollery")
+		if err != nil {
+			return err
+		}
+		logWriter = w
+		backend, err = logging.NewSyslogBackend("gollery")
+		if err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown log output: %s", Config.Log.Output)
+	}
+
+	logging.SetBackend(backend)
+	logging.SetLevel(level, "gollery")
+
+	return nil
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"time"
 )
 
+const (
+	COMBINED_TIME_FORMAT = "02/Jan/2006:15:04:05 -0700"
+)
+
 type logHandler struct {
 	writer  io.Writer
 	handler http.Handler
@@ -18,7 +24,15 @@ func (h logHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	logger := &responseLogger{w: w}
 	h.handler.ServeHTTP(logger, req)
 
-	// Write the log message
+	writeLog(h.writer, req, t, logger.Status(), logger.Size())
+}
+
+func LogHandler(out io.Writer, h http.Handler) http.Handler {
+	return logHandler{out, h}
+}
+
+// Write a log line for a request in the configured format
+func writeLog(w io.Writer, req *http.Request, t time.Time, status int, size int) {
 	var host string
 
 	if realIP, ok := req.Header["X-Real-Ip"]; ok {
@@ -32,23 +46,52 @@ func (h logHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	// Log it
-	log.Info("\"%s\" %s \"%s %s %s\" %d %d -- %s",
-		getGallery(req),
-		host,
-		req.Method,
-		req.URL.RequestURI(),
-		req.Proto,
-		logger.Status(),
-		logger.Size(),
-		time.Since(t),
-	)
-	//writeLog(h.writer, req, t, logger.Status(), logger.Size())
-}
+	switch Config.Log.Format {
+	case "combined":
+		fmt.Fprintf(w, "%s - - [%s] \"%s %s %s\" %d %d %q %q\n",
+			host,
+			t.Format(COMBINED_TIME_FORMAT),
+			req.Method,
+			req.URL.RequestURI(),
+			req.Proto,
+			status,
+			size,
+			req.Referer(),
+			req.UserAgent(),
+		)
 
-func LogHandler(out io.Writer, h http.Handler) http.Handler {
-	log.Info("LogHandler()")
-	return logHandler{out, h}
+	case "json":
+		b, err := json.Marshal(map[string]interface{}{
+			"time":       t.Format(time.RFC3339),
+			"gallery":    getGallery(req),
+			"host":       host,
+			"method":     req.Method,
+			"uri":        req.URL.RequestURI(),
+			"proto":      req.Proto,
+			"status":     status,
+			"size":       size,
+			"duration":   time.Since(t).Seconds(),
+			"referer":    req.Referer(),
+			"user_agent": req.UserAgent(),
+		})
+		if err != nil {
+			log.Error("writeLog: %s", err)
+			return
+		}
+		w.Write(append(b, '\n'))
+
+	default:
+		log.Info("\"%s\" %s \"%s %s %s\" %d %d -- %s",
+			getGallery(req),
+			host,
+			req.Method,
+			req.URL.RequestURI(),
+			req.Proto,
+			status,
+			size,
+			time.Since(t),
+		)
+	}
 }
 
 // responseLogger is wrapper of http.ResponseWriter that keeps track of its HTTP status
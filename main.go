@@ -2,13 +2,13 @@ package main
 
 import (
 	"code.google.com/p/gcfg"
-	"crypto/md5"
+	"crypto/subtle"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/mux"
 	"github.com/op/go-logging"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -18,10 +18,13 @@ import (
 
 const (
 	PREFIXES = "0123456789abcdef"
+	// Seconds per image in slideshows
+	SLIDESHOW_INTERVAL = 5
 )
 
 var (
 	cache       = NewGalleryCache()
+	cmChan      = CoverMaker()
 	log         = logging.MustGetLogger("gollery")
 	staticFiles = make(map[string]string)
 	tn          = NewThumbnailer()
@@ -50,11 +53,47 @@ var redisPool = &redis.Pool{
 type GalleryConfig struct {
 	Name        string
 	BaseURL     string
+	PublicURL   string
 	ImagePath   string
 	ThumbPath   string
 	ThumbWidth  int
 	ThumbHeight int
 	VideoPath   string
+	CoverRule   string
+	FolderTree  bool
+	FeedSort    string
+	Symlinks    string
+	Theme       string
+	ThemeCSS    []string
+
+	SlideshowInterval     int
+	RecentCount           int
+	ContentSecurityPolicy string
+
+	ImageCacheControl string
+	ThumbCacheControl string
+	VideoCacheControl string
+
+	Offload         string
+	OffloadImageURL string
+	OffloadThumbURL string
+	OffloadVideoURL string
+
+	IncludeDir  []string
+	ExcludeDir  []string
+	IncludeFile []string
+	ExcludeFile []string
+
+	Upload         bool
+	UploadUsername string
+	UploadPassword string
+	UploadMaxSize  int
+
+	EditUsername string
+	EditPassword string
+
+	ZipMaxFiles int
+	ZipMaxSize  int
 }
 
 var Config struct {
@@ -63,6 +102,15 @@ var Config struct {
 		CacheTime          int
 		DefaultThumbWidth  int
 		DefaultThumbHeight int
+		MaxPixels          int
+		AssetPath          string
+		DevMode            bool
+
+		ContentSecurityPolicy string
+
+		ImageCacheControl string
+		ThumbCacheControl string
+		VideoCacheControl string
 	}
 
 	Redis struct {
@@ -70,15 +118,28 @@ var Config struct {
 		Database         int
 	}
 
+	Admin struct {
+		Listen   string
+		Username string
+		Password string
+	}
+
+	Log struct {
+		Level  string
+		Output string
+		File   string
+		Format string
+	}
+
+	Tool map[string]*ToolConfig
+
 	Gallery map[string]*GalleryConfig
 }
 
 func main() {
-	// Set up logging
-	var format = logging.MustStringFormatter(" %{level: -8s}  %{message}")
-	logging.SetFormatter(format)
+	// Set up logging, this is replaced once the config file is loaded
+	logging.SetFormatter(logging.MustStringFormatter(LOG_TEXT_FORMAT))
 	logging.SetLevel(logging.DEBUG, "gollery")
-	// logging.SetLevel(logging.INFO, "gmc")
 
 	log.Info("Gollery starting...")
 
@@ -91,6 +152,21 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if err = SetupLogging(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Default Cache-Control headers, galleries can override these
+	if Config.Global.ImageCacheControl == "" {
+		Config.Global.ImageCacheControl = CACHE_CONTROL_IMAGES
+	}
+	if Config.Global.ThumbCacheControl == "" {
+		Config.Global.ThumbCacheControl = CACHE_CONTROL_IMMUTABLE
+	}
+	if Config.Global.VideoCacheControl == "" {
+		Config.Global.VideoCacheControl = CACHE_CONTROL_IMMUTABLE
+	}
+
 	// Update defaults
 	for name, gallery := range Config.Gallery {
 		// Update defaults
@@ -106,6 +182,54 @@ func main() {
 		if gallery.ThumbWidth == 0 {
 			gallery.ThumbWidth = Config.Global.DefaultThumbWidth
 		}
+		if gallery.CoverRule == "" {
+			gallery.CoverRule = "newest"
+		}
+		if gallery.FeedSort == "" {
+			gallery.FeedSort = FEED_SORT_MTIME
+		}
+		if gallery.RecentCount <= 0 {
+			gallery.RecentCount = RECENT_COUNT
+		} else if gallery.RecentCount > RECENT_MAX {
+			// The index doesn't keep any more than that
+			log.Warning("Gallery %s: RecentCount %d is more than %d, using %d", name, gallery.RecentCount, RECENT_MAX, RECENT_MAX)
+			gallery.RecentCount = RECENT_MAX
+		}
+		if gallery.SlideshowInterval <= 0 {
+			gallery.SlideshowInterval = SLIDESHOW_INTERVAL
+		}
+		if gallery.Symlinks == "" {
+			gallery.Symlinks = SYMLINKS_GALLERY
+		}
+		if gallery.ContentSecurityPolicy == "" {
+			gallery.ContentSecurityPolicy = Config.Global.ContentSecurityPolicy
+		}
+		if gallery.ImageCacheControl == "" {
+			gallery.ImageCacheControl = Config.Global.ImageCacheControl
+		}
+		if gallery.ThumbCacheControl == "" {
+			gallery.ThumbCacheControl = Config.Global.ThumbCacheControl
+		}
+		if gallery.VideoCacheControl == "" {
+			gallery.VideoCacheControl = Config.Global.VideoCacheControl
+		}
+
+		if !validSymlinks(gallery.Symlinks) {
+			log.Fatalf("Gallery %s: unknown Symlinks policy %q", name, gallery.Symlinks)
+		}
+
+		switch gallery.Offload {
+		case "", OFFLOAD_NGINX, OFFLOAD_SENDFILE:
+		default:
+			log.Fatalf("Gallery %s: unknown Offload mode %q", name, gallery.Offload)
+		}
+
+		// Clean paths so prefix checks work
+		gallery.ImagePath = filepath.Clean(gallery.ImagePath)
+		gallery.ThumbPath = filepath.Clean(gallery.ThumbPath)
+		if gallery.VideoPath != "" {
+			gallery.VideoPath = filepath.Clean(gallery.VideoPath)
+		}
 
 		gallery.InitThumbDirs()
 	}
@@ -118,50 +242,64 @@ func main() {
 		}
 	}()
 
-	// Generate hashed filenames for static files
-	fileNames, err := ioutil.ReadDir("static")
-	if err != nil {
+	// Load templates and static files
+	if err = SetupAssets(); err != nil {
 		log.Fatal(err)
 	}
 
-	for _, fileInfo := range fileNames {
-		fileName := fileInfo.Name()
-		filePath := path.Join("static", fileName)
-
-		b, err := ioutil.ReadFile(filePath)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		ext := path.Ext(fileName)
-		staticFiles[fileName] = strings.Replace(fileName, ext, fmt.Sprintf(".%x%s", md5.Sum(b), ext), 1)
-	}
-
 	// Set up HTTP handling
 	r := mux.NewRouter()
 
+	// Health checks, these don't need an X-Gollery header
+	r.Handle("/healthz", metricsHandler("health", http.HandlerFunc(HealthzHandler)))
+	r.Handle("/readyz", metricsHandler("health", http.HandlerFunc(ReadyzHandler)))
+
 	// Serve static files
-	r.HandleFunc("/favicon.ico", serveStatic)
-	r.HandleFunc("/robots.txt", serveStatic)
+	r.Handle("/favicon.ico", metricsHandler("static", http.HandlerFunc(serveStatic)))
+	r.Handle("/robots.txt", metricsHandler("static", http.HandlerFunc(serveStatic)))
 
-	for fileName, hashName := range staticFiles {
-		r.Path("/.static/" + hashName).Handler(expiresHandler(30, staticHandler(fileName)))
-	}
+	addStaticRoutes(r)
 	//r.PathPrefix("/.static/").Handler(http.StripPrefix("/.static", noDirFileServer(http.FileServer(http.Dir("static/")))))
 
 	// Serve image and video files
-	r.PathPrefix("/.images/").Handler(http.StripPrefix("/.images", http.HandlerFunc(ImageHandler)))
-	r.PathPrefix("/.videos/").Handler(http.StripPrefix("/.videos", http.HandlerFunc(VideoHandler)))
+	r.PathPrefix("/.images/").Handler(metricsHandler("image", http.StripPrefix("/.images", http.HandlerFunc(ImageHandler))))
+	r.PathPrefix("/.videos/").Handler(metricsHandler("video", http.StripPrefix("/.videos", http.HandlerFunc(VideoHandler))))
 	// Serve thumbnail files
-	r.PathPrefix("/.thumbs/").Handler(http.StripPrefix("/.thumbs", expiresHandler(30, http.HandlerFunc(ThumbHandler))))
+	r.PathPrefix("/.thumbs/").Handler(metricsHandler("thumb", http.StripPrefix("/.thumbs", http.HandlerFunc(ThumbHandler))))
+	// Viewer-sized copies of images
+	r.PathPrefix("/.previews/").Handler(metricsHandler("preview", http.StripPrefix("/.previews", http.HandlerFunc(PreviewHandler))))
+	// ZIP downloads
+	r.PathPrefix("/.zip/").Handler(metricsHandler("zip", http.StripPrefix("/.zip", http.HandlerFunc(ZipHandler))))
+	// Recently added images
+	r.Handle("/.recent/", metricsHandler("recent", http.HandlerFunc(RecentHandler)))
+	// Images by date
+	r.PathPrefix("/.dates").Handler(metricsHandler("dates", http.HandlerFunc(DatesHandler)))
+	// Tags, albums and searching them
+	r.PathPrefix("/.tags/").Handler(metricsHandler("tags", http.HandlerFunc(TagsHandler)))
+	r.PathPrefix("/.albums/").Handler(metricsHandler("albums", http.HandlerFunc(AlbumsHandler)))
+	r.Handle("/.search/", metricsHandler("search", http.HandlerFunc(SearchHandler)))
+	r.PathPrefix("/.api/tags/").Handler(metricsHandler("api", http.StripPrefix("/.api/tags", http.HandlerFunc(TagsAPIHandler))))
+	albumsAPI := metricsHandler("api", http.StripPrefix("/.api/albums", http.HandlerFunc(AlbumsAPIHandler)))
+	r.Handle("/.api/albums", albumsAPI)
+	r.PathPrefix("/.api/albums/").Handler(albumsAPI)
+	// Atom feeds
+	r.PathPrefix("/.feed/").Handler(metricsHandler("feed", http.StripPrefix("/.feed", http.HandlerFunc(FeedHandler))))
+	// Folder tree
+	r.Handle("/.tree/", metricsHandler("tree", http.HandlerFunc(TreeHandler)))
+	// Uploads
+	r.PathPrefix("/.upload/").Handler(metricsHandler("upload", http.StripPrefix("/.upload", http.HandlerFunc(UploadHandler))))
+	r.PathPrefix("/.mkdir/").Handler(metricsHandler("upload", http.StripPrefix("/.mkdir", http.HandlerFunc(MkdirHandler))))
 	// Serve galleries
-	r.PathPrefix("/").Handler(LogHandler(os.Stdout, http.HandlerFunc(GalleryHandler)))
+	r.PathPrefix("/").Handler(metricsHandler("gallery", http.HandlerFunc(GalleryHandler)))
 
 	http.Handle("/", r)
 
+	// Start the admin listener
+	AdminServer()
+
 	// Listen and serve
 	log.Info("Listening on %s", Config.Global.Listen)
-	if err = http.ListenAndServe(Config.Global.Listen, r); err != nil {
+	if err = http.ListenAndServe(Config.Global.Listen, LogHandler(logWriter, r)); err != nil {
 		panic(err)
 	}
 }
@@ -175,6 +313,11 @@ func (g *GalleryConfig) InitThumbDirs() {
 			}
 		}
 
+		dirPath = path.Join(g.ThumbPath, PREVIEW_DIR, string(d))
+		if err := os.MkdirAll(dirPath, 0755); err != nil {
+			log.Warning("Mkdir error: %s", err)
+		}
+
 		if g.VideoPath != "" {
 			dirPath = path.Join(g.VideoPath, string(d))
 			if err := os.Mkdir(dirPath, 0755); err != nil {
@@ -196,19 +339,26 @@ func noDirFileServer(h http.Handler) http.HandlerFunc {
 	})
 }
 
+// Add routes for the hashed static files
+func addStaticRoutes(r *mux.Router) {
+	for fileName, hashName := range staticFiles {
+		r.Path("/.static/" + hashName).Handler(metricsHandler("static", expiresHandler(30, staticHandler(fileName))))
+	}
+}
+
 // Serve a static file using the URL path
 func serveStatic(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, path.Join("static", r.URL.Path))
+	serveStaticFile(w, r, path.Base(r.URL.Path))
 }
 
 // Serve a static file using a specific filename
 func staticHandler(filename string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, path.Join("static", filename))
+		serveStaticFile(w, r, filename)
 	})
 }
 
-// Dumb expires handler
+// Dumb expires handler, for static files with hashed names
 func expiresHandler(days int, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Cache-Control
@@ -216,7 +366,7 @@ func expiresHandler(days int, h http.Handler) http.Handler {
 		w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", secs))
 
 		// Expires
-		expires := time.Now().AddDate(0, 0, 30).UTC().Format(time.RFC1123)
+		expires := time.Now().AddDate(0, 0, days).UTC().Format(time.RFC1123)
 		w.Header().Add("Expires", expires)
 
 		h.ServeHTTP(w, r)
@@ -235,3 +385,40 @@ func getGallery(r *http.Request) string {
 
 	return gallery
 }
+
+// Check HTTP basic auth credentials, an empty username or password never matches
+func checkBasicAuth(r *http.Request, wantUsername, wantPassword string) bool {
+	if wantUsername == "" || wantPassword == "" {
+		return false
+	}
+
+	username, password, ok := r.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(wantUsername)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(wantPassword)) == 1
+}
+
+// Check that a state-changing request came from one of our own pages. Browsers send
+// Sec-Fetch-Site and/or Origin (or at least Referer) with cross-site form posts, so a page
+// elsewhere can't ride on cached basic auth credentials. Requests with none of them aren't
+// from a browser and are left to the auth check.
+func checkSameOrigin(r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+		return true
+	}
+
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
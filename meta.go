@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"code.google.com/p/gcfg"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	META_FILE         = ".gollery.conf"
+	DESCRIPTIONS_FILE = "descriptions.txt"
+)
+
+// Optional metadata for a folder, from .gollery.conf and/or descriptions.txt
+type FolderMeta struct {
+	Title       string            `json:"title,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Cover       string            `json:"cover,omitempty"`
+	Captions    map[string]string `json:"captions,omitempty"`
+	// Titles of subfolders, from their own metadata
+	DirTitles map[string]string `json:"dirs,omitempty"`
+}
+
+// .gollery.conf looks like this:
+//
+//	[Folder]
+//	Title=Summer holiday
+//	Description=Two weeks at the beach
+//	Cover=IMG_0001.jpg
+//
+//	[Image "IMG_0001.jpg"]
+//	Caption=The first sunset
+type folderMetaConfig struct {
+	Folder struct {
+		Title       string
+		Description string
+		Cover       string
+	}
+	Image map[string]*struct {
+		Caption string
+	}
+}
+
+// Load the metadata for a folder. Broken files are logged and ignored, we'd rather
+// show the images without captions than not at all.
+func loadFolderMeta(dirPath string) *FolderMeta {
+	meta := &FolderMeta{
+		Captions: make(map[string]string),
+	}
+
+	// descriptions.txt is "<filename> <caption>" per line, # for comments
+	if f, err := os.Open(path.Join(dirPath, DESCRIPTIONS_FILE)); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			parts := strings.SplitN(line, " ", 2)
+			if len(parts) == 2 {
+				meta.Captions[parts[0]] = strings.TrimSpace(parts[1])
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			log.Warning("loadFolderMeta(%s): %s", dirPath, err)
+		}
+		f.Close()
+	}
+
+	// .gollery.conf wins if both exist
+	metaPath := path.Join(dirPath, META_FILE)
+	if _, err := os.Stat(metaPath); err == nil {
+		var mc folderMetaConfig
+		if err = gcfg.ReadFileInto(&mc, metaPath); err != nil {
+			log.Warning("loadFolderMeta(%s): %s", dirPath, err)
+		} else {
+			meta.Title = mc.Folder.Title
+			meta.Description = mc.Folder.Description
+			meta.Cover = mc.Folder.Cover
+			for fileName, image := range mc.Image {
+				if image.Caption != "" {
+					meta.Captions[fileName] = image.Caption
+				}
+			}
+		}
+	}
+
+	return meta
+}
+
+// Load just the title for a folder, for listing subfolders
+func loadFolderTitle(dirPath string) string {
+	if _, err := os.Stat(path.Join(dirPath, META_FILE)); err != nil {
+		return ""
+	}
+
+	return loadFolderMeta(dirPath).Title
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gollery_http_requests_total",
+		Help: "HTTP requests by gallery, handler and status code.",
+	}, []string{"gallery", "handler", "code"})
+	metricRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "gollery_http_request_duration_seconds",
+		Help: "HTTP request latency by gallery and handler.",
+	}, []string{"gallery", "handler"})
+
+	metricCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gollery_cache_hits_total",
+		Help: "GalleryCache lookups that found a fresh entry.",
+	})
+	metricCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gollery_cache_misses_total",
+		Help: "GalleryCache lookups that found nothing or an expired entry.",
+	})
+
+	metricScanDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gollery_scan_duration_seconds",
+		Help:    "Time taken by ScanFolder when the cache missed.",
+		Buckets: []float64{.01, .05, .1, .5, 1, 2.5, 5, 10, 15, 30},
+	})
+	metricScanTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gollery_scan_timeouts_total",
+		Help: "ScanFolder runs that hit THUMBNAIL_TIMEOUT.",
+	})
+
+	metricThumbnails = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gollery_thumbnails_total",
+		Help: "Thumbnails generated, by result.",
+	}, []string{"result"})
+
+	metricTranscodeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gollery_transcode_duration_seconds",
+		Help:    "Time taken by VideoMaker to make a webm.",
+		Buckets: []float64{.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricRequests,
+		metricRequestDuration,
+		metricCacheHits,
+		metricCacheMisses,
+		metricScanDuration,
+		metricScanTimeouts,
+		metricThumbnails,
+		metricTranscodeDuration,
+	)
+
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gollery_cache_entries",
+		Help: "Number of paths in GalleryCache.",
+	}, func() float64 {
+		return float64(cache.Len())
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gollery_videomaker_queue_depth",
+		Help: "Folders waiting for VideoMaker.",
+	}, func() float64 {
+		return float64(len(vmChan))
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gollery_redis_active_connections",
+		Help: "Active connections in the Redis pool.",
+	}, func() float64 {
+		return float64(redisPool.ActiveCount())
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gollery_redis_idle_connections",
+		Help: "Idle connections in the Redis pool.",
+	}, func() float64 {
+		return float64(redisPool.IdleCount())
+	}))
+}
+
+// Count and time requests for a handler
+func metricsHandler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+		logger := &responseLogger{w: w}
+		h.ServeHTTP(logger, r)
+
+		gallery := getGallery(r)
+		metricRequests.WithLabelValues(gallery, name, strconv.Itoa(logger.Status())).Inc()
+		metricRequestDuration.WithLabelValues(gallery, name).Observe(time.Since(t).Seconds())
+	})
+}
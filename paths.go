@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Never follow symlinks
+	SYMLINKS_DENY = "deny"
+	// Follow symlinks that stay inside the gallery root
+	SYMLINKS_GALLERY = "gallery"
+	// Follow symlinks anywhere, trust whoever can write to ImagePath
+	SYMLINKS_FOLLOW = "follow"
+)
+
+var (
+	errPathRefused = errors.New("path refused")
+)
+
+// Resolve a request path inside root using a symlink policy. Returns the cleaned path
+// (not the symlink target) so it can be used as a key, or an error if the path escapes
+// root or breaks the policy.
+func resolvePath(root, reqPath, policy string) (string, error) {
+	root = filepath.Clean(root)
+	cleanPath := filepath.Join(root, filepath.FromSlash(path.Clean("/"+reqPath)))
+	if !withinRoot(root, cleanPath) {
+		return "", errPathRefused
+	}
+
+	switch policy {
+	case SYMLINKS_FOLLOW:
+		return cleanPath, nil
+
+	case SYMLINKS_DENY:
+		rel, err := filepath.Rel(root, cleanPath)
+		if err != nil {
+			return "", err
+		}
+		if rel == "." {
+			return cleanPath, nil
+		}
+
+		cur := root
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			cur = filepath.Join(cur, part)
+			fi, err := os.Lstat(cur)
+			if err != nil {
+				return "", err
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				return "", errPathRefused
+			}
+		}
+		return cleanPath, nil
+
+	case SYMLINKS_GALLERY:
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return "", err
+		}
+		realPath, err := filepath.EvalSymlinks(cleanPath)
+		if err != nil {
+			return "", err
+		}
+		if !withinRoot(realRoot, realPath) {
+			return "", errPathRefused
+		}
+		return cleanPath, nil
+
+	default:
+		// Config checking should stop this happening, but don't guess
+		return "", errPathRefused
+	}
+}
+
+// Is a Symlinks setting one we know about?
+func validSymlinks(policy string) bool {
+	return policy == SYMLINKS_DENY || policy == SYMLINKS_GALLERY || policy == SYMLINKS_FOLLOW
+}
+
+// Is p the same as root or inside it? A plain prefix check would let /data/img2 through
+// for a root of /data/img.
+func withinRoot(root, p string) bool {
+	root = filepath.Clean(root)
+	p = filepath.Clean(p)
+	if root == string(filepath.Separator) {
+		return filepath.IsAbs(p)
+	}
+	return p == root || strings.HasPrefix(p, root+string(filepath.Separator))
+}
+
+// Resolve a request path inside the gallery's ImagePath
+func (g *GalleryConfig) resolveImagePath(reqPath string) (string, error) {
+	return resolvePath(g.ImagePath, reqPath, g.Symlinks)
+}
+
+// Stat a symlink found while listing a folder, if the gallery's policy allows it
+func (g *GalleryConfig) statSymlink(linkPath string) (os.FileInfo, error) {
+	switch g.Symlinks {
+	case SYMLINKS_FOLLOW:
+
+	case SYMLINKS_GALLERY:
+		realRoot, err := filepath.EvalSymlinks(g.ImagePath)
+		if err != nil {
+			return nil, err
+		}
+		realPath, err := filepath.EvalSymlinks(linkPath)
+		if err != nil {
+			return nil, err
+		}
+		if !withinRoot(realRoot, realPath) {
+			return nil, errPathRefused
+		}
+
+	default:
+		return nil, errPathRefused
+	}
+
+	return os.Stat(linkPath)
+}
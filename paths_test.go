@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Build a tree with a gallery, a sibling directory sharing its prefix and a secret file
+//
+//	base/img/a.jpg
+//	base/img/sub/b.jpg
+//	base/img/inside -> base/img/sub
+//	base/img/outside -> base/img2
+//	base/img/secret -> base/secret.txt
+//	base/img2/c.jpg
+//	base/secret.txt
+func makeTree(t *testing.T) (string, string) {
+	base, err := ioutil.TempDir("", "gollery-paths")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(base, "img")
+	for _, dir := range []string{root, filepath.Join(root, "sub"), filepath.Join(base, "img2")} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{
+		filepath.Join(root, "a.jpg"),
+		filepath.Join(root, "sub", "b.jpg"),
+		filepath.Join(base, "img2", "c.jpg"),
+		filepath.Join(base, "secret.txt"),
+	} {
+		if err = ioutil.WriteFile(file, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		filepath.Join(root, "inside"):  filepath.Join(root, "sub"),
+		filepath.Join(root, "outside"): filepath.Join(base, "img2"),
+		filepath.Join(root, "secret"):  filepath.Join(base, "secret.txt"),
+	}
+	for link, target := range links {
+		if err = os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return base, root
+}
+
+func TestWithinRoot(t *testing.T) {
+	tests := []struct {
+		root, p string
+		want    bool
+	}{
+		{"/data/img", "/data/img", true},
+		{"/data/img", "/data/img/a.jpg", true},
+		{"/data/img/", "/data/img/sub/b.jpg", true},
+		{"/data/img", "/data/img2", false},
+		{"/data/img", "/data/img2/c.jpg", false},
+		{"/data/img", "/data", false},
+		{"/data/img", "/data/img/../secret.txt", false},
+		{"/", "/anything", true},
+	}
+
+	for _, test := range tests {
+		if got := withinRoot(test.root, test.p); got != test.want {
+			t.Errorf("withinRoot(%q, %q) = %v, want %v", test.root, test.p, got, test.want)
+		}
+	}
+}
+
+func TestResolvePathTraversal(t *testing.T) {
+	base, root := makeTree(t)
+	defer os.RemoveAll(base)
+
+	// Traversal attempts get clamped to the root, so they can't reach the secret
+	for _, policy := range []string{SYMLINKS_DENY, SYMLINKS_GALLERY, SYMLINKS_FOLLOW} {
+		for _, reqPath := range []string{
+			"../secret.txt",
+			"/../secret.txt",
+			"sub/../../secret.txt",
+			"../img2/c.jpg",
+			"/../../../../etc/passwd",
+		} {
+			cleanPath, err := resolvePath(root, reqPath, policy)
+			if err == nil && !withinRoot(root, cleanPath) {
+				t.Errorf("resolvePath(%q, %s) escaped to %s", reqPath, policy, cleanPath)
+			}
+			if err == nil {
+				if _, err = os.Stat(cleanPath); err == nil {
+					t.Errorf("resolvePath(%q, %s) resolved to existing %s", reqPath, policy, cleanPath)
+				}
+			}
+		}
+	}
+}
+
+func TestResolvePathSymlinks(t *testing.T) {
+	base, root := makeTree(t)
+	defer os.RemoveAll(base)
+
+	tests := []struct {
+		reqPath string
+		policy  string
+		ok      bool
+	}{
+		// Plain files are always fine
+		{"a.jpg", SYMLINKS_DENY, true},
+		{"sub/b.jpg", SYMLINKS_DENY, true},
+		{"", SYMLINKS_DENY, true},
+		{"a.jpg", SYMLINKS_GALLERY, true},
+		{"a.jpg", SYMLINKS_FOLLOW, true},
+
+		// Links that stay inside the gallery
+		{"inside/b.jpg", SYMLINKS_DENY, false},
+		{"inside/b.jpg", SYMLINKS_GALLERY, true},
+		{"inside/b.jpg", SYMLINKS_FOLLOW, true},
+
+		// Links to a sibling directory with the same prefix
+		{"outside/c.jpg", SYMLINKS_DENY, false},
+		{"outside/c.jpg", SYMLINKS_GALLERY, false},
+		{"outside/c.jpg", SYMLINKS_FOLLOW, true},
+
+		// Links to files elsewhere
+		{"secret", SYMLINKS_DENY, false},
+		{"secret", SYMLINKS_GALLERY, false},
+		{"secret", SYMLINKS_FOLLOW, true},
+
+		// Missing files
+		{"nope.jpg", SYMLINKS_DENY, false},
+		{"nope.jpg", SYMLINKS_GALLERY, false},
+
+		// Unknown policies refuse everything
+		{"a.jpg", "Deny", false},
+		{"inside/b.jpg", "", false},
+	}
+
+	for _, test := range tests {
+		_, err := resolvePath(root, test.reqPath, test.policy)
+		if (err == nil) != test.ok {
+			t.Errorf("resolvePath(%q, %s) error = %v, want ok = %v", test.reqPath, test.policy, err, test.ok)
+		}
+	}
+}
+
+func TestStatSymlink(t *testing.T) {
+	base, root := makeTree(t)
+	defer os.RemoveAll(base)
+
+	tests := []struct {
+		link   string
+		policy string
+		ok     bool
+	}{
+		{"inside", SYMLINKS_DENY, false},
+		{"inside", SYMLINKS_GALLERY, true},
+		{"outside", SYMLINKS_GALLERY, false},
+		{"outside", SYMLINKS_FOLLOW, true},
+		{"secret", SYMLINKS_GALLERY, false},
+		{"inside", "Deny", false},
+	}
+
+	for _, test := range tests {
+		g := &GalleryConfig{ImagePath: root, Symlinks: test.policy}
+		_, err := g.statSymlink(filepath.Join(root, test.link))
+		if (err == nil) != test.ok {
+			t.Errorf("statSymlink(%q, %s) error = %v, want ok = %v", test.link, test.policy, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// Longest side of the viewer's previews
+	PREVIEW_SIZE = 1600
+	// Folder inside ThumbPath for previews
+	PREVIEW_DIR = "previews"
+)
+
+// One convert at a time, previews are made on demand and anyone can ask
+var previewLock sync.Mutex
+
+// Serve a viewer-sized copy of an image, /.previews/folder/IMG_0001.jpg. They're made the
+// first time they're asked for and kept in ThumbPath/previews, named after the original's
+// hash like thumbnails.
+func PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	// Check the gallery header
+	g := getGallery(r)
+	if g == "" {
+		http.NotFound(w, r)
+		return
+	}
+	gallery := Config.Gallery[g]
+
+	// Excluded files are off limits, not just hidden
+	reqPath := path.Clean("/" + r.URL.Path)
+	if gallery.PathExcluded(reqPath, false) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Only images the scanner knows about, broken ones don't have a hash
+	info := gallery.imageContent(gallery.ImagePath, reqPath)
+	if info == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	previewPart := path.Join(info.Hash[:1], info.Hash+".jpg")
+	if !etagMatch(r.Header.Get("If-None-Match"), info.ETag()) {
+		if err := makePreview(gallery, reqPath, previewPart, info); err != nil {
+			// The original will do, but don't let it be cached as the preview
+			log.Warning("PreviewHandler(%s): %s", reqPath, err.Error())
+			u := &url.URL{Path: gallery.BaseURL + ".images" + reqPath}
+			http.Redirect(w, r, u.EscapedPath(), http.StatusFound)
+			return
+		}
+	}
+
+	// The URL is the image's, so it gets revalidated like the original
+	offloadURL := ""
+	if gallery.OffloadThumbURL != "" {
+		offloadURL = strings.TrimSuffix(gallery.OffloadThumbURL, "/") + "/" + PREVIEW_DIR + "/"
+	}
+	r.URL.Path = "/" + previewPart
+	galleryStaticHandler(w, r, gallery, staticRoot{filepath.Join(gallery.ThumbPath, PREVIEW_DIR), gallery.ImageCacheControl, offloadURL, contentAddressed})
+}
+
+// Make the preview for an image, unless it's already there
+func makePreview(gallery *GalleryConfig, reqPath, previewPart string, info *contentInfo) error {
+	previewPath := filepath.Join(gallery.ThumbPath, PREVIEW_DIR, filepath.FromSlash(previewPart))
+
+	previewLock.Lock()
+	defer previewLock.Unlock()
+
+	if _, err := os.Stat(previewPath); err == nil {
+		return nil
+	}
+
+	filePath, err := resolvePath(gallery.ImagePath, reqPath, gallery.Symlinks)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	// The hash is from the last scan, don't file a changed image under it
+	if !info.Matches(fi) {
+		return fmt.Errorf("changed since it was scanned")
+	}
+
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	if err = checkPixels(b); err != nil {
+		return err
+	}
+
+	// Never serve a half-made preview
+	tmpPath := previewPath + ".tmp"
+	size := fmt.Sprintf("%dx%d>", PREVIEW_SIZE, PREVIEW_SIZE)
+	if out, err := runTool("convert", fmt.Sprintf("%s[0]", filePath), "-resize", size, "-quality", "85", "jpg:"+tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("convert failed: %s %q", err, out)
+	}
+
+	return os.Rename(tmpPath, previewPath)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"os"
+	"path"
+)
+
+const (
+	// Sorted set of image paths by mtime, per gallery
+	RECENT_KEY = "recent:%s"
+	// Images kept in the index, older ones fall off the end
+	RECENT_MAX = 1000
+	// Images shown on the page by default
+	RECENT_COUNT = 100
+)
+
+// Add a folder's new or changed images to the recent index and drop the ones that have gone away
+func updateRecent(conn redis.Conn, gallery *GalleryConfig, changed map[string]ImageInfo, removed []string) error {
+	key := fmt.Sprintf(RECENT_KEY, gallery.ImagePath)
+
+	if len(removed) > 0 {
+		args := redis.Args{}.Add(key)
+		for _, imagePath := range removed {
+			args = args.Add(imagePath)
+		}
+		if _, err := conn.Do("ZREM", args...); err != nil {
+			return err
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	args := redis.Args{}.Add(key)
+	for _, imageInfo := range changed {
+		args = args.Add(imageInfo.ModTime, imageInfo.ImagePath)
+	}
+	if _, err := conn.Do("ZADD", args...); err != nil {
+		return err
+	}
+
+	// Trim the oldest ones
+	_, err := conn.Do("ZREMRANGEBYRANK", key, 0, -(RECENT_MAX + 1))
+	return err
+}
+
+// Serve the recently added images for a gallery as a virtual folder
+func RecentHandler(w http.ResponseWriter, r *http.Request) {
+	// Check the gallery header
+	g := getGallery(r)
+	if g == "" {
+		http.NotFound(w, r)
+		return
+	}
+	gallery := Config.Gallery[g]
+
+	// Get a Redis connection
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf(RECENT_KEY, gallery.ImagePath)
+	imagePaths, err := redis.Strings(conn.Do("ZREVRANGE", key, 0, gallery.RecentCount-1))
+	if err != nil {
+		log.Error("RecentHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	images, err := lookupImages(conn, gallery, imagePaths)
+	if err != nil {
+		log.Error("RecentHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	p := virtualPage(g, gallery, "Recently added", "/.recent/", []Crumb{{Name: "Recently added"}})
+	p.Images = images
+	renderTemplate(w, "gallery", g, p)
+}
+
+// Fetch the ImageInfo for a list of image paths relative to ImagePath, keeping the order.
+// Anything that's gone or hidden is skipped.
+func lookupImages(conn redis.Conn, gallery *GalleryConfig, imagePaths []string) ([]ImageInfo, error) {
+	fileMaps := make(map[string]map[string]ImageInfo)
+	metas := make(map[string]*FolderMeta)
+
+	var images []ImageInfo
+	for _, imagePath := range imagePaths {
+		if gallery.PathExcluded(imagePath, false) {
+			continue
+		}
+
+		dir := path.Dir(imagePath)
+		fileMap, ok := fileMaps[dir]
+		if !ok {
+			dirPath := path.Join(gallery.ImagePath, dir)
+
+			// Deleted folders only get noticed here, nothing is going to scan them
+			if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+				tn.ForgetFolder(conn, gallery, dirPath)
+				fileMap = nil
+			} else if fileMap, err = getFileMap(conn, dirPath); err != nil {
+				return nil, err
+			}
+			fileMaps[dir] = fileMap
+			metas[dir] = loadFolderMeta(dirPath)
+		}
+
+		imageInfo, ok := fileMap[path.Base(imagePath)]
+		if !ok || imageInfo.ThumbPath == "" {
+			continue
+		}
+
+		// Captions aren't stored in Redis, and virtual folders need to link back to the real one
+		imageInfo.applyCaption(metas[dir])
+		imageInfo.Folder = imageFolder(imagePath)
+		images = append(images, imageInfo)
+	}
+
+	return images, nil
+}
+
+// A Page for something that isn't a real folder. crumbs go after the gallery root, the last
+// one is the current page.
+func virtualPage(g string, gallery *GalleryConfig, title, urlPath string, crumbs []Crumb) *Page {
+	crumbs = append(getCrumbs(gallery, "/"), crumbs...)
+	for i := range crumbs {
+		crumbs[i].Current = i == len(crumbs)-1
+	}
+
+	return &Page{
+		BaseURL:           gallery.BaseURL,
+		Name:              gallery.Name,
+		Path:              urlPath,
+		Title:             title,
+		StaticBroken:      staticFiles["broken.png"],
+		StaticCSS:         staticFiles["gollery.min.css"],
+		StaticFolder:      staticFiles["folder.png"],
+		StaticJS:          staticFiles["gollery.min.js"],
+		ThemeCSS:          themeCSS[g],
+		Crumbs:            crumbs,
+		FolderTree:        gallery.FolderTree,
+		SlideshowInterval: gallery.SlideshowInterval,
+		Virtual:           true,
+	}
+}
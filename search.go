@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Search tags and albums, /.search/?q=red car. Images need every word as a tag (or the
+// whole thing, for tags with spaces), tags and albums just need to contain it.
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	// Check the gallery header
+	g := getGallery(r)
+	if g == "" {
+		http.NotFound(w, r)
+		return
+	}
+	gallery := Config.Gallery[g]
+
+	query := strings.TrimSpace(r.FormValue("q"))
+	p := virtualPage(g, gallery, "Search", "/.search/", []Crumb{{Name: "Search"}})
+	p.Query = query
+
+	if query != "" {
+		// Get a Redis connection
+		conn := redisPool.Get()
+		defer conn.Close()
+
+		whole := normaliseTags([]string{query})[0]
+		p.Title = "Search: " + query
+
+		tagDirs, err := tagDirs(conn, gallery, whole)
+		if err != nil {
+			log.Error("SearchHandler: %s", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		albumDirs, err := albumDirs(conn, gallery, strings.ToLower(query))
+		if err != nil {
+			log.Error("SearchHandler: %s", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		p.Dirs = append(albumDirs, tagDirs...)
+
+		images, err := taggedImages(conn, gallery, strings.Fields(query))
+		if err != nil {
+			log.Error("SearchHandler: %s", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if strings.Contains(whole, " ") {
+			more, err := taggedImages(conn, gallery, []string{whole})
+			if err != nil {
+				log.Error("SearchHandler: %s", err.Error())
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			images = mergeImages(images, more)
+		}
+		p.Images = images
+	}
+
+	renderTemplate(w, "gallery", g, p)
+}
+
+// Add images that aren't already in the list
+func mergeImages(images []ImageInfo, more []ImageInfo) []ImageInfo {
+	seen := make(map[string]bool)
+	for _, imageInfo := range images {
+		seen[imageInfo.ImagePath] = true
+	}
+	for _, imageInfo := range more {
+		if !seen[imageInfo.ImagePath] {
+			images = append(images, imageInfo)
+		}
+	}
+	return images
+}
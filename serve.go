@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Originals can change under us, so revalidate them now and then
+	CACHE_CONTROL_IMAGES = "public, max-age=86400"
+	// Thumbnails and webms are named after the hash of the original, a new image gets a new URL
+	CACHE_CONTROL_IMMUTABLE = "public, max-age=31536000, immutable"
+)
+
+const (
+	// Let nginx send the file from an internal location
+	OFFLOAD_NGINX = "nginx"
+	// Let Apache/lighttpd send the file using its local path
+	OFFLOAD_SENDFILE = "sendfile"
+)
+
+const (
+	// How long imageContent remembers a folder's data
+	CONTENT_CACHE_TIME = time.Minute
+	CONTENT_CACHE_MAX  = 1000
+)
+
+type contentCacheEntry struct {
+	CacheUntil time.Time
+	FileMap    map[string]ImageInfo
+}
+
+var contentCache = struct {
+	sync.Mutex
+	Paths map[string]contentCacheEntry
+}{
+	Paths: make(map[string]contentCacheEntry),
+}
+
+var (
+	reContentName = regexp.MustCompile("^([0-9a-f]{32})\\.[a-z]+$")
+)
+
+// What we know about a file's content without looking at the disk. FileSize and ModTime
+// are zero if the name is the hash and the content can't change.
+type contentInfo struct {
+	Hash     string
+	FileSize int64
+	ModTime  int64
+}
+
+// Strong ETag for a content hash
+func (c *contentInfo) ETag() string {
+	return fmt.Sprintf("\"%s\"", c.Hash)
+}
+
+// Does the stored hash still describe this file?
+func (c *contentInfo) Matches(fi os.FileInfo) bool {
+	if c.FileSize == 0 && c.ModTime == 0 {
+		return true
+	}
+	return c.FileSize == fi.Size() && c.ModTime == fi.ModTime().Unix()
+}
+
+// Looks up the content info for a request path, nil if we don't know it
+type contentLookup func(basePath, reqPath string) *contentInfo
+
+// One of the directories a gallery serves files from
+type staticRoot struct {
+	Path         string
+	CacheControl string
+	// Internal location for X-Accel-Redirect, empty to serve it ourselves
+	OffloadURL string
+	Lookup     contentLookup
+}
+
+// Serve a file from one of a gallery's directories with caching headers. If the lookup
+// knows the hash, a matching If-None-Match gets a 304 straight away: thumbnails and webms
+// are named after their hash, and originals use what the scanner stored in Redis, so
+// revalidations never touch the disk. Everything else is checked and stat'd, then ranges
+// and the rest of the conditional headers are left to http.ServeContent, or the front-end
+// server if the gallery offloads files.
+func galleryStaticHandler(w http.ResponseWriter, r *http.Request, gallery *GalleryConfig, root staticRoot) {
+	reqPath := path.Clean("/" + r.URL.Path)
+
+	var info *contentInfo
+	if root.Lookup != nil {
+		info = root.Lookup(root.Path, reqPath)
+	}
+
+	// Short cut for revalidations. The lookup only knows about files that passed the
+	// checks below when they were scanned, and a 304 gives nothing away anyway.
+	if info != nil && (r.Method == "GET" || r.Method == "HEAD") && etagMatch(r.Header.Get("If-None-Match"), info.ETag()) {
+		w.Header().Set("Cache-Control", root.CacheControl)
+		w.Header().Set("ETag", info.ETag())
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Check path
+	cleanPath, err := resolvePath(root.Path, reqPath, gallery.Symlinks)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Never directories
+	fi, err := os.Stat(cleanPath)
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Only send the stored hash if the file hasn't changed since it was scanned
+	if info != nil && !info.Matches(fi) {
+		info = nil
+	}
+
+	// Let the front-end server do the heavy lifting
+	if gallery.Offload == OFFLOAD_SENDFILE || (gallery.Offload == OFFLOAD_NGINX && root.OffloadURL != "") {
+		w.Header().Set("Cache-Control", root.CacheControl)
+		if info != nil {
+			w.Header().Set("ETag", info.ETag())
+		}
+		if gallery.Offload == OFFLOAD_NGINX {
+			u := &url.URL{Path: strings.TrimSuffix(root.OffloadURL, "/") + reqPath}
+			w.Header().Set("X-Accel-Redirect", u.EscapedPath())
+		} else {
+			w.Header().Set("X-Sendfile", cleanPath)
+		}
+		return
+	}
+
+	// Serve it
+	f, err := os.Open(cleanPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Cache-Control", root.CacheControl)
+	if info != nil {
+		w.Header().Set("ETag", info.ETag())
+	}
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// Content info for thumbnails and webms, which are named <hash>.<ext> in a folder named
+// after the first character of the hash
+func contentAddressed(basePath, reqPath string) *contentInfo {
+	dir, name := path.Split(reqPath)
+	matches := reContentName.FindStringSubmatch(name)
+	if matches == nil || dir != "/"+matches[1][:1]+"/" {
+		return nil
+	}
+
+	return &contentInfo{Hash: matches[1]}
+}
+
+// Content info for original images, from the folder cache or Redis. The thumbnail name
+// is the md5 of the original, so we get a hash for free.
+func (g *GalleryConfig) imageContent(basePath, reqPath string) *contentInfo {
+	imagePart := strings.TrimPrefix(reqPath, "/")
+	dirPath := filepath.Dir(filepath.Join(basePath, filepath.FromSlash(imagePart)))
+
+	var imageInfo ImageInfo
+	var found bool
+
+	if _, images, _, ok := cache.Get(dirPath); ok {
+		for _, ii := range images {
+			if ii.ImagePath == imagePart {
+				imageInfo, found = ii, true
+				break
+			}
+		}
+	} else {
+		fileMap, err := contentFileMap(dirPath)
+		if err != nil {
+			log.Warning("imageContent(%s): %s", reqPath, err.Error())
+			return nil
+		}
+		imageInfo, found = fileMap[path.Base(imagePart)]
+	}
+
+	// Broken images don't have a thumbnail, so no hash either
+	if !found || imageInfo.ThumbPath == "" {
+		return nil
+	}
+
+	return &contentInfo{
+		Hash:     strings.TrimSuffix(path.Base(imageInfo.ThumbPath), path.Ext(imageInfo.ThumbPath)),
+		FileSize: imageInfo.FileSize,
+		ModTime:  imageInfo.ModTime,
+	}
+}
+
+// Folder data from Redis for imageContent, kept for a little while so a page full of
+// originals doesn't decode the same JSON over and over
+func contentFileMap(dirPath string) (map[string]ImageInfo, error) {
+	contentCache.Lock()
+	entry, ok := contentCache.Paths[dirPath]
+	contentCache.Unlock()
+	if ok && time.Now().Before(entry.CacheUntil) {
+		return entry.FileMap, nil
+	}
+
+	// Get a Redis connection
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	fileMap, err := getFileMap(conn, dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	contentCache.Lock()
+	defer contentCache.Unlock()
+	// Plenty for the folders people are looking at, start over if it gets silly
+	if len(contentCache.Paths) >= CONTENT_CACHE_MAX {
+		contentCache.Paths = make(map[string]contentCacheEntry)
+	}
+	contentCache.Paths[dirPath] = contentCacheEntry{time.Now().Add(CONTENT_CACHE_TIME), fileMap}
+
+	return fileMap, nil
+}
+
+// Does an If-None-Match header match etag? Uses the weak comparison, like RFC 7232 says.
+func etagMatch(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// Hash of image path -> JSON list of all of its tags, per gallery
+	TAGS_KEY = "tags:%s"
+	// Hash of image path -> JSON list of tags added through the API, per gallery
+	USER_TAGS_KEY = "usertags:%s"
+	// Set of image paths with a tag, per gallery
+	TAG_KEY = "tag:%s:%s"
+	// Sorted set of tag -> number of images, per gallery
+	TAG_LIST_KEY = "taglist:%s"
+	// Times setTags tries again when the tags change while it's working
+	SET_TAGS_RETRIES = 10
+)
+
+// A tag and its page, for templates
+type TagLink struct {
+	Name string
+	Path string
+}
+
+// Lowercase, tidy up whitespace, sort and remove duplicates. Slashes would get confused
+// with paths so they become dashes.
+func normaliseTags(tags []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, tag := range tags {
+		tag = strings.Join(strings.Fields(strings.ToLower(tag)), " ")
+		tag = strings.Replace(tag, "/", "-", -1)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			out = append(out, tag)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Embedded keywords plus whatever was added through the API
+func mergeTags(keywords []string, userTags []string) []string {
+	return normaliseTags(append(append([]string{}, keywords...), userTags...))
+}
+
+func tagsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Decode a JSON list of tags from Redis, nil is fine
+func decodeTags(v interface{}) []string {
+	b, err := redis.Bytes(v, nil)
+	if err != nil {
+		return nil
+	}
+	var tags []string
+	json.Unmarshal(b, &tags)
+	return tags
+}
+
+// Get the tags for an image
+func getTags(conn redis.Conn, gallery *GalleryConfig, imagePath string) ([]string, error) {
+	v, err := conn.Do("HGET", fmt.Sprintf(TAGS_KEY, gallery.ImagePath), imagePath)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTags(v), nil
+}
+
+// Get the tags added through the API for an image
+func getUserTags(conn redis.Conn, gallery *GalleryConfig, imagePath string) ([]string, error) {
+	v, err := conn.Do("HGET", fmt.Sprintf(USER_TAGS_KEY, gallery.ImagePath), imagePath)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTags(v), nil
+}
+
+// Change an image's tags to newTags, keeping the tag sets and counts in step. The old tags
+// are read under WATCH so changes to the same image at once can't get the counts wrong.
+func setTags(conn redis.Conn, gallery *GalleryConfig, imagePath string, newTags []string) error {
+	tagsKey := fmt.Sprintf(TAGS_KEY, gallery.ImagePath)
+	listKey := fmt.Sprintf(TAG_LIST_KEY, gallery.ImagePath)
+
+	var b []byte
+	if len(newTags) > 0 {
+		var err error
+		if b, err = json.Marshal(newTags); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < SET_TAGS_RETRIES; i++ {
+		if _, err := conn.Do("WATCH", tagsKey); err != nil {
+			return err
+		}
+
+		oldTags, err := getTags(conn, gallery, imagePath)
+		if err != nil || tagsEqual(oldTags, newTags) {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		conn.Send("MULTI")
+
+		had := make(map[string]bool)
+		for _, tag := range oldTags {
+			had[tag] = true
+		}
+		for _, tag := range newTags {
+			if had[tag] {
+				delete(had, tag)
+			} else {
+				conn.Send("SADD", fmt.Sprintf(TAG_KEY, gallery.ImagePath, tag), imagePath)
+				conn.Send("ZINCRBY", listKey, 1, tag)
+			}
+		}
+		for tag := range had {
+			conn.Send("SREM", fmt.Sprintf(TAG_KEY, gallery.ImagePath, tag), imagePath)
+			conn.Send("ZINCRBY", listKey, -1, tag)
+		}
+		conn.Send("ZREMRANGEBYSCORE", listKey, "-inf", 0)
+
+		if b != nil {
+			conn.Send("HSET", tagsKey, imagePath, b)
+		} else {
+			conn.Send("HDEL", tagsKey, imagePath)
+		}
+
+		// A nil reply means the tags changed under us, go around again
+		reply, err := conn.Do("EXEC")
+		if err != nil || reply != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("setTags(%s): gave up after %d tries", imagePath, SET_TAGS_RETRIES)
+}
+
+// Bring the tag index up to date for a folder's new or changed images, and drop the ones
+// that have gone away
+func updateTags(conn redis.Conn, gallery *GalleryConfig, changed map[string]ImageInfo, removed []string) error {
+	tagsKey := fmt.Sprintf(TAGS_KEY, gallery.ImagePath)
+	userKey := fmt.Sprintf(USER_TAGS_KEY, gallery.ImagePath)
+
+	for _, imagePath := range removed {
+		if err := setTags(conn, gallery, imagePath, nil); err != nil {
+			return err
+		}
+		if _, err := conn.Do("HDEL", userKey, imagePath); err != nil {
+			return err
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	var images []ImageInfo
+	tagsArgs := redis.Args{}.Add(tagsKey)
+	userArgs := redis.Args{}.Add(userKey)
+	for _, imageInfo := range changed {
+		images = append(images, imageInfo)
+		tagsArgs = tagsArgs.Add(imageInfo.ImagePath)
+		userArgs = userArgs.Add(imageInfo.ImagePath)
+	}
+
+	oldTags, err := redis.Values(conn.Do("HMGET", tagsArgs...))
+	if err != nil {
+		return err
+	}
+	userTags, err := redis.Values(conn.Do("HMGET", userArgs...))
+	if err != nil {
+		return err
+	}
+
+	for i, imageInfo := range images {
+		// setTags checks again, this just saves it the trouble for the ones that haven't changed
+		tags := mergeTags(imageInfo.Keywords, decodeTags(userTags[i]))
+		if !tagsEqual(decodeTags(oldTags[i]), tags) {
+			if err = setTags(conn, gallery, imageInfo.ImagePath, tags); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Path of a tag's page, without the trailing slash like DirInfo.Path
+func tagPath(gallery *GalleryConfig, tag string) string {
+	return gallery.BaseURL + ".tags/" + url.PathEscape(tag)
+}
+
+// Tags with links to their pages
+func tagLinks(gallery *GalleryConfig, tags []string) []TagLink {
+	var links []TagLink
+	for _, tag := range tags {
+		links = append(links, TagLink{tag, tagPath(gallery, tag)})
+	}
+	return links
+}
+
+// Serve /.tags/ (all tags) and /.tags/<tag>/ (images with that tag) as virtual folders
+func TagsHandler(w http.ResponseWriter, r *http.Request) {
+	// Check the gallery header
+	g := getGallery(r)
+	if g == "" {
+		http.NotFound(w, r)
+		return
+	}
+	gallery := Config.Gallery[g]
+
+	// Get a Redis connection
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	tag := strings.Trim(strings.TrimPrefix(r.URL.Path, "/.tags"), "/")
+	crumbs := []Crumb{{Name: "Tags", Path: gallery.BaseURL + ".tags/"}}
+
+	if tag == "" {
+		dirs, err := tagDirs(conn, gallery, "")
+		if err != nil {
+			log.Error("TagsHandler: %s", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		p := virtualPage(g, gallery, "Tags", "/.tags/", crumbs)
+		p.Dirs = dirs
+		renderTemplate(w, "gallery", g, p)
+		return
+	}
+
+	images, err := taggedImages(conn, gallery, []string{tag})
+	if err != nil {
+		log.Error("TagsHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(images) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	p := virtualPage(g, gallery, tag, r.URL.Path, append(crumbs, Crumb{Name: tag}))
+	p.Images = images
+	renderTemplate(w, "gallery", g, p)
+}
+
+// Tags as dirs, optionally only the ones containing a string
+func tagDirs(conn redis.Conn, gallery *GalleryConfig, match string) ([]DirInfo, error) {
+	counts, err := redis.Int64Map(conn.Do("ZRANGE", fmt.Sprintf(TAG_LIST_KEY, gallery.ImagePath), 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []DirInfo
+	for tag, count := range counts {
+		if strings.Contains(tag, match) {
+			dirs = append(dirs, DirInfo{
+				tagPath(gallery, tag),
+				fmt.Sprintf("%s (%d)", tag, count),
+				".static/" + staticFiles["folder.png"],
+			})
+		}
+	}
+	sort.Sort(byDirName(dirs))
+
+	return dirs, nil
+}
+
+// Images with all of the tags, sorted by path
+func taggedImages(conn redis.Conn, gallery *GalleryConfig, tags []string) ([]ImageInfo, error) {
+	args := redis.Args{}
+	for _, tag := range normaliseTags(tags) {
+		args = args.Add(fmt.Sprintf(TAG_KEY, gallery.ImagePath, tag))
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	imagePaths, err := redis.Strings(conn.Do("SINTER", args...))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(imagePaths)
+
+	return lookupImages(conn, gallery, imagePaths)
+}
+
+type byDirName []DirInfo
+
+func (a byDirName) Len() int           { return len(a) }
+func (a byDirName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDirName) Less(i, j int) bool { return a[i].Name < a[j].Name }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Funcs available to every template, including themes
+var templateFuncs = template.FuncMap{
+	"formatSize":   formatSize,
+	"formatTime":   formatTime,
+	"formatRating": formatRating,
+	"static":       staticURL,
+	"lower":        strings.ToLower,
+	"upper":        strings.ToUpper,
+}
+
+// Templates a theme can replace
+var themeTemplates = []string{"gallery", "image"}
+
+var (
+	reNotSlug = regexp.MustCompile("[^A-Za-z0-9_-]+")
+
+	// Page templates for galleries with a Theme
+	themeTmpl = make(map[string]map[string]*template.Template)
+	// Hashed names of each gallery's ThemeCSS files
+	themeCSS = make(map[string][]string)
+)
+
+// Parse a page template, files in themeDir replace the default ones
+func parseTemplate(name, themeDir string) (*template.Template, error) {
+	fsys := templateFS
+	if themeDir != "" {
+		fsys = overlayFS{os.DirFS(themeDir), templateFS}
+	}
+
+	return template.New(name).Funcs(templateFuncs).ParseFS(fsys, name+".html", "base.html")
+}
+
+// Parse the default templates and every gallery's theme
+func loadTemplates() error {
+	for _, name := range []string{"gallery", "image", "admin"} {
+		t, err := parseTemplate(name, "")
+		if err != nil {
+			return err
+		}
+		tmpl[name] = t
+	}
+
+	for key, gallery := range Config.Gallery {
+		if gallery.Theme == "" {
+			continue
+		}
+
+		themeTmpl[key] = make(map[string]*template.Template)
+		for _, name := range themeTemplates {
+			t, err := parseTemplate(name, gallery.Theme)
+			if err != nil {
+				return fmt.Errorf("gallery %s theme: %s", key, err)
+			}
+			themeTmpl[key][name] = t
+		}
+	}
+
+	return nil
+}
+
+// Get a template for a gallery, "" for none. DevMode parses it again every time so
+// template edits show up without a restart.
+func getTemplate(name, galleryKey string) (*template.Template, error) {
+	var themeDir string
+	if gallery, ok := Config.Gallery[galleryKey]; ok && name != "admin" {
+		themeDir = gallery.Theme
+	}
+
+	if Config.Global.DevMode {
+		return parseTemplate(name, themeDir)
+	}
+	if themeDir != "" {
+		return themeTmpl[galleryKey][name], nil
+	}
+	return tmpl[name], nil
+}
+
+// Load each gallery's extra CSS files as static files, they end up under .static/themes/<gallery>/
+func loadThemeCSS() error {
+	for key, gallery := range Config.Gallery {
+		for _, cssPath := range gallery.ThemeCSS {
+			if !filepath.IsAbs(cssPath) {
+				cssPath = filepath.Join(gallery.Theme, cssPath)
+			}
+
+			b, err := ioutil.ReadFile(cssPath)
+			if err != nil {
+				return fmt.Errorf("gallery %s theme: %s", key, err)
+			}
+
+			fileName := path.Join("themes", reNotSlug.ReplaceAllString(key, "-"), filepath.Base(cssPath))
+			if err = addStaticFile(fileName, b); err != nil {
+				return err
+			}
+			themeCSS[key] = append(themeCSS[key], staticFiles[fileName])
+		}
+	}
+
+	return nil
+}
+
+// Hashed name of a static file, for templates
+func staticURL(fileName string) string {
+	return staticFiles[fileName]
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io/ioutil"
-	"os/exec"
+	"os"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -18,6 +23,9 @@ import (
 
 const (
 	THUMBNAIL_TIMEOUT = time.Duration(15) * time.Second
+	// Bump this when the IPTC/XMP reader learns something new, older entries get their
+	// metadata read again without redoing the thumbnail
+	META_VERSION = 1
 )
 
 var (
@@ -40,8 +48,22 @@ type ImageInfo struct {
 	ImageWidth  int    `json:"w"`
 	ImageHeight int    `json:"h"`
 	ThumbPath   string `json:"t"`
+	Taken       int64  `json:"x,omitempty"`
+	TakenRead   bool   `json:"xr,omitempty"`
+	Caption     string `json:"c,omitempty"`
+	Broken      bool   `json:"b,omitempty"`
 	VideoPath   string `json:"-"`
 	VideoSize   int64  `json:"-"`
+	// Embedded or sidecar IPTC/XMP metadata, and the sidecar's mtime
+	Description string   `json:"e,omitempty"`
+	Keywords    []string `json:"k,omitempty"`
+	Rating      int      `json:"r,omitempty"`
+	Copyright   string   `json:"cr,omitempty"`
+	Creator     string   `json:"by,omitempty"`
+	SidecarTime int64    `json:"st,omitempty"`
+	MetaVersion int      `json:"mv,omitempty"`
+	// Folder the image is in, for virtual folders
+	Folder string `json:"-"`
 }
 
 type Thumbnailer struct {
@@ -71,7 +93,7 @@ func (t *Thumbnailer) GetMutex(basePath string) *sync.Mutex {
 	}
 }
 
-func (t *Thumbnailer) ScanFolder(gallery *GalleryConfig, basePath string) ([]string, []ImageInfo, error) {
+func (t *Thumbnailer) ScanFolder(gallery *GalleryConfig, basePath string) ([]string, []ImageInfo, *FolderMeta, error) {
 	start := time.Now()
 	// defer func() {
 	// 	log.Info("ScanFolder(%s) took %s", basePath, time.Since(start))
@@ -83,11 +105,15 @@ func (t *Thumbnailer) ScanFolder(gallery *GalleryConfig, basePath string) ([]str
 	defer m.Unlock()
 
 	// Check cache
-	cacheDirs, cacheImages, cacheOk := cache.Get(basePath)
+	cacheDirs, cacheImages, cacheMeta, cacheOk := cache.Get(basePath)
 	if cacheOk {
-		return cacheDirs, cacheImages, nil
+		return cacheDirs, cacheImages, cacheMeta, nil
 	}
 
+	defer func() {
+		metricScanDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	// Get a Redis connection
 	conn := redisPool.Get()
 	defer conn.Close()
@@ -98,8 +124,13 @@ func (t *Thumbnailer) ScanFolder(gallery *GalleryConfig, basePath string) ([]str
 
 	// Get the files
 	fileNames, err := ioutil.ReadDir(basePath)
-	if err != nil {
-		return nil, nil, err
+	if os.IsNotExist(err) {
+		if ferr := forgetFolder(conn, gallery, basePath); ferr != nil {
+			log.Warning("ScanFolder(%s) forget: %s", basePath, ferr.Error())
+		}
+		return nil, nil, nil, err
+	} else if err != nil {
+		return nil, nil, nil, err
 	}
 
 	// Subfolders need a fake .. directory
@@ -107,24 +138,41 @@ func (t *Thumbnailer) ScanFolder(gallery *GalleryConfig, basePath string) ([]str
 		dirs = append(dirs, "..")
 	}
 
+	// Path relative to the gallery root, for exclude patterns
+	relDir := gallery.relPath(basePath)
+
+	// Nobody is coming back for these
+	expireUploadParts(basePath, fileNames)
+
+	// XMP sidecars, so we can tell when they change
+	sidecars := make(map[string]os.FileInfo)
+	for _, fileInfo := range fileNames {
+		if strings.EqualFold(path.Ext(fileInfo.Name()), ".xmp") && fileInfo.Mode().IsRegular() {
+			sidecars[strings.ToLower(fileInfo.Name())] = fileInfo
+		}
+	}
+
+	// Captions and things
+	meta := loadFolderMeta(basePath)
+	meta.DirTitles = make(map[string]string)
+
 	// Try fetching data from Redis
 	fileMap, err := getFileMap(conn, basePath)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	// Some things
-	resizeStr := fmt.Sprintf("%dx%d^", gallery.ThumbWidth, gallery.ThumbHeight)
-	extentStr := fmt.Sprintf("%dx%d", gallery.ThumbWidth, gallery.ThumbHeight)
-
 	// Iterateee
-	var latest ImageInfo
 	updateCache := true
+	seen := make(map[string]bool)
+	// New or re-read images, the only ones the indexes need to hear about
+	changed := make(map[string]ImageInfo)
 	// t3 := time.Now()
 	for _, fileInfo := range fileNames {
 		// Exit the loop if time expires
 		if time.Since(start) > THUMBNAIL_TIMEOUT {
 			log.Debug("ScanFolder timeout")
+			metricScanTimeouts.Inc()
 			updateCache = false
 			break
 		}
@@ -133,11 +181,21 @@ func (t *Thumbnailer) ScanFolder(gallery *GalleryConfig, basePath string) ([]str
 
 		fileName := fileInfo.Name()
 
+		// Symlinks need checking against the gallery's policy
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			if fileInfo, err = gallery.statSymlink(path.Join(basePath, fileName)); err != nil {
+				continue
+			}
+		}
+
 		// Directories don't need any further processing
 		if fileInfo.IsDir() {
-			// Skip dotdirectories
-			if !strings.HasPrefix(fileName, ".") {
+			// Skip dotdirectories and excluded folders
+			if !gallery.Excluded(path.Join(relDir, fileName), true) {
 				dirs = append(dirs, fileName)
+				if title := loadFolderTitle(path.Join(basePath, fileName)); title != "" {
+					meta.DirTitles[fileName] = title
+				}
 			}
 			continue
 		}
@@ -148,61 +206,113 @@ func (t *Thumbnailer) ScanFolder(gallery *GalleryConfig, basePath string) ([]str
 			continue
 		}
 
+		// Or excluded ones
+		if gallery.Excluded(path.Join(relDir, fileName), false) {
+			continue
+		}
+
 		// Check to see if the image has changed
 		fileModTime := fileInfo.ModTime().Unix()
 		fileSize := fileInfo.Size()
 
+		seen[fileName] = true
+
+		filePath := path.Join(basePath, fileName)
+
+		// Build an image title
+		imageTitle := strings.Replace(fileMatches[0][1], "_", " ", -1)
+
+		// Has the sidecar changed?
+		var sidecarPath string
+		var sidecarTime int64
+		if fi := findSidecar(sidecars, fileName); fi != nil {
+			sidecarPath = path.Join(basePath, fi.Name())
+			sidecarTime = fi.ModTime().Unix()
+		}
+
 		imageInfo, ok := fileMap[fileName]
 		if ok && imageInfo.FileSize == fileSize && imageInfo.ModTime == fileModTime && imageInfo.ThumbPath != "" {
+			// Only the metadata needs updating, the thumbnail is fine. Images scanned before
+			// feeds existed never had their capture time read.
+			rereadMeta := imageInfo.SidecarTime != sidecarTime || imageInfo.MetaVersion < META_VERSION
+			if rereadMeta || !imageInfo.TakenRead {
+				if b, err := ioutil.ReadFile(filePath); err == nil {
+					if !imageInfo.TakenRead {
+						imageInfo.Taken = exifTaken(b)
+						imageInfo.TakenRead = true
+					}
+					if rereadMeta {
+						imageInfo.applyMeta(readImageMeta(b, readSidecar(sidecarPath)), imageTitle)
+						imageInfo.SidecarTime = sidecarTime
+						imageInfo.MetaVersion = META_VERSION
+					}
+					fileMap[fileName] = imageInfo
+					changed[fileName] = imageInfo
+				}
+			}
 			images = append(images, imageInfo)
 			continue
 		}
 
-		filePath := path.Join(basePath, fileName)
+		imagePart, _ := filepath.Rel(gallery.ImagePath, filePath)
+
+		// Skip files that failed before, unless they have changed since
+		failure, err := getFailure(conn, FAILED_CONVERT, filePath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if failure.Matches(fileSize, fileModTime) {
+			images = append(images, brokenImage(imagePart, imageTitle, fileSize, fileModTime))
+			continue
+		}
 
 		// Generate the thumbnail filename and path
 		b, err := ioutil.ReadFile(filePath)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
-		thumbName := fmt.Sprintf("%x.jpg", md5.Sum(b))
-		thumbPart := path.Join(string(thumbName[0]), thumbName)
-		thumbPath := path.Join(gallery.ThumbPath, thumbPart)
 
 		// Generate the thumbnail image and save it
 		// t := time.Now()
 
-		cmd := exec.Command("convert", fmt.Sprintf("%s[0]", filePath), "-thumbnail", resizeStr, "-gravity", "center", "-quality", "90", "-extent", extentStr, "-verbose", thumbPath)
-		out, err := cmd.CombinedOutput()
+		thumbPart, out, err := makeThumbnail(gallery, filePath, b)
 		if err != nil {
 			log.Warning("convert failed: %q", out)
-			continue
 		}
 
 		// Get image dimensions from the output
 		matches := reDimensions.FindAllStringSubmatch(string(out), -1)
-		if len(matches) == 0 {
+		if err == nil && len(matches) == 0 {
 			log.Warning("matches failed: %q", out)
-			return nil, nil, err
+		}
+
+		// Remember the failure so we don't try again until the file changes
+		if err != nil || len(matches) == 0 {
+			metricThumbnails.WithLabelValues("failed").Inc()
+			if err = recordFailure(conn, FAILED_CONVERT, filePath, fileSize, fileModTime, string(out)); err != nil {
+				return nil, nil, nil, err
+			}
+			images = append(images, brokenImage(imagePart, imageTitle, fileSize, fileModTime))
+			continue
+		} else if failure != nil {
+			if err = clearFailure(conn, FAILED_CONVERT, filePath); err != nil {
+				return nil, nil, nil, err
+			}
 		}
 
 		imageWidth, err := strconv.ParseInt(matches[0][1], 10, 32)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		imageHeight, err := strconv.ParseInt(matches[0][2], 10, 32)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 
-		// Build an image title
-		imageTitle := strings.Replace(fileMatches[0][1], "_", " ", -1)
+		metricThumbnails.WithLabelValues("generated").Inc()
 
 		// log.Debug("thumbnail for %s took %s", filePath, time.Since(t))
 
-		// Finish junk
-		imagePart, _ := filepath.Rel(gallery.ImagePath, filePath)
-
 		imageInfo = ImageInfo{
 			FileSize:    fileSize,
 			ModTime:     fileModTime,
@@ -211,22 +321,35 @@ func (t *Thumbnailer) ScanFolder(gallery *GalleryConfig, basePath string) ([]str
 			ImageWidth:  int(imageWidth),
 			ImageHeight: int(imageHeight),
 			ThumbPath:   thumbPart,
+			Taken:       exifTaken(b),
+			TakenRead:   true,
+			SidecarTime: sidecarTime,
+			MetaVersion: META_VERSION,
 		}
+		imageInfo.applyMeta(readImageMeta(b, readSidecar(sidecarPath)), imageTitle)
 		images = append(images, imageInfo)
 		fileMap[fileName] = imageInfo
-
-		// Update the 'latest' thumb
-		if latest.ModTime < imageInfo.ModTime {
-			latest = imageInfo
-		}
+		changed[fileName] = imageInfo
 
 		log.Debug("loop for %s took %s", filePath, time.Since(tl))
 	}
 	// log.Debug("Loop took %s", time.Since(t3))
 
-	// Update cache
+	// Apply captions, these aren't saved to Redis so edits show up when the cache expires
+	for i := range images {
+		images[i].applyCaption(meta)
+	}
+
+	// Update cache, and forget files that have gone away if we saw everything
+	var removed []string
 	if updateCache {
-		cache.Set(basePath, dirs, images)
+		cache.Set(basePath, dirs, images, meta)
+		for fileName, imageInfo := range fileMap {
+			if !seen[fileName] {
+				removed = append(removed, imageInfo.ImagePath)
+				delete(fileMap, fileName)
+			}
+		}
 	} else {
 		cache.Delete(basePath)
 	}
@@ -234,19 +357,119 @@ func (t *Thumbnailer) ScanFolder(gallery *GalleryConfig, basePath string) ([]str
 	// Update Redis
 	b, err := json.Marshal(fileMap)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	conn.Do("HSET", "images", basePath, string(b))
 
-	// If there was a latest image, update the dir thumb
-	if latest.ModTime > 0 {
-		conn.Do("HSET", "dirthumb", basePath, latest.ThumbPath)
+	// Keep the recently added, date, feed and tag indexes up to date
+	if err = updateRecent(conn, gallery, changed, removed); err != nil {
+		log.Warning("ScanFolder(%s) recent: %s", basePath, err.Error())
+	}
+	if err = updateDates(conn, gallery, changed, removed); err != nil {
+		log.Warning("ScanFolder(%s) dates: %s", basePath, err.Error())
+	}
+	// Feeds get the whole folder so a new FeedSort and folders scanned before the index existed catch up
+	if err = updateFeed(conn, gallery, fileMap, removed); err != nil {
+		log.Warning("ScanFolder(%s) feed: %s", basePath, err.Error())
+	}
+	if err = updateTags(conn, gallery, changed, removed); err != nil {
+		log.Warning("ScanFolder(%s) tags: %s", basePath, err.Error())
+	}
+
+	// Update the dir thumb, an empty one means there's nothing to use
+	coverPath, err := chooseCover(gallery, meta, images)
+	if err != nil {
+		log.Warning("ScanFolder(%s) cover: %s", basePath, err.Error())
+	} else if coverPath != "" || updateCache {
+		conn.Do("HSET", "dirthumb", basePath, coverPath)
 	}
 
 	// Send the gallery data to the video maker
 	vmChan <- FolderData{basePath, &fileMap, gallery}
 
-	return dirs, images, nil
+	return dirs, images, meta, nil
+}
+
+// Use IPTC/XMP metadata for the image, the title falls back to one made from the filename
+func (i *ImageInfo) applyMeta(m ImageMeta, imageTitle string) {
+	i.ImageTitle = imageTitle
+	if m.Title != "" {
+		i.ImageTitle = m.Title
+	}
+	i.Description = m.Description
+	i.Keywords = m.Keywords
+	i.Rating = m.Rating
+	i.Copyright = m.Copyright
+	i.Creator = m.Creator
+}
+
+// Captions from the folder metadata win, otherwise use the IPTC/XMP description
+func (i *ImageInfo) applyCaption(meta *FolderMeta) {
+	if caption, ok := meta.Captions[path.Base(i.ImagePath)]; ok {
+		i.Caption = caption
+	} else {
+		i.Caption = i.Description
+	}
+}
+
+// Read a sidecar file, missing or broken ones are just empty
+func readSidecar(sidecarPath string) []byte {
+	if sidecarPath == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(sidecarPath)
+	if err != nil {
+		log.Warning("readSidecar(%s): %s", sidecarPath, err.Error())
+		return nil
+	}
+	return b
+}
+
+// Make a thumbnail for an image, named after its contents. Returns the path relative to
+// ThumbPath and the output of convert, which has the image dimensions in it.
+func makeThumbnail(gallery *GalleryConfig, filePath string, b []byte) (string, []byte, error) {
+	thumbName := fmt.Sprintf("%x.jpg", md5.Sum(b))
+	thumbPart := path.Join(string(thumbName[0]), thumbName)
+	thumbPath := path.Join(gallery.ThumbPath, thumbPart)
+
+	if err := checkPixels(b); err != nil {
+		return thumbPart, []byte(err.Error()), err
+	}
+
+	resizeStr := fmt.Sprintf("%dx%d^", gallery.ThumbWidth, gallery.ThumbHeight)
+	extentStr := fmt.Sprintf("%dx%d", gallery.ThumbWidth, gallery.ThumbHeight)
+	out, err := runTool("convert", fmt.Sprintf("%s[0]", filePath), "-thumbnail", resizeStr, "-gravity", "center", "-quality", "90", "-extent", extentStr, "-verbose", thumbPath)
+	return thumbPart, out, err
+}
+
+// Refuse images with more pixels than MaxPixels, decompression bombs are no fun
+func checkPixels(b []byte) error {
+	if Config.Global.MaxPixels <= 0 {
+		return nil
+	}
+
+	// If we can't decode the header, let convert have a go at it
+	ic, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+
+	if ic.Width*ic.Height > Config.Global.MaxPixels {
+		return fmt.Errorf("image too large: %dx%d is more than %d pixels", ic.Width, ic.Height, Config.Global.MaxPixels)
+	}
+
+	return nil
+}
+
+// Build a placeholder ImageInfo for an image that could not be thumbnailed
+func brokenImage(imagePart, imageTitle string, fileSize, modTime int64) ImageInfo {
+	return ImageInfo{
+		FileSize:   fileSize,
+		ModTime:    modTime,
+		ImageTitle: imageTitle,
+		ImagePath:  imagePart,
+		Broken:     true,
+	}
 }
 
 func getFileMap(conn redis.Conn, basePath string) (map[string]ImageInfo, error) {
@@ -268,3 +491,67 @@ func getFileMap(conn redis.Conn, basePath string) (map[string]ImageInfo, error)
 
 	return fileMap, err
 }
+
+// Forget a folder that turned out to be missing outside of a scan, unless it's back
+func (t *Thumbnailer) ForgetFolder(conn redis.Conn, gallery *GalleryConfig, basePath string) {
+	// Acquire lock
+	m := t.GetMutex(basePath)
+	m.Lock()
+	defer m.Unlock()
+
+	if _, err := os.Stat(basePath); !os.IsNotExist(err) {
+		return
+	}
+	if err := forgetFolder(conn, gallery, basePath); err != nil {
+		log.Warning("ForgetFolder(%s): %s", basePath, err.Error())
+	}
+}
+
+// Forget a folder that has gone away, and everything under it, so the indexes stop
+// pointing at images that 404
+func forgetFolder(conn redis.Conn, gallery *GalleryConfig, basePath string) error {
+	basePaths := []string{basePath}
+	err := hscanPrefix(conn, "images", basePath+"/", func(field, value string) error {
+		basePaths = append(basePaths, field)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, bp := range basePaths {
+		fileMap, err := getFileMap(conn, bp)
+		if err != nil {
+			return err
+		}
+
+		var removed []string
+		for _, imageInfo := range fileMap {
+			removed = append(removed, imageInfo.ImagePath)
+		}
+		if err = updateRecent(conn, gallery, nil, removed); err != nil {
+			return err
+		}
+		if err = updateDates(conn, gallery, nil, removed); err != nil {
+			return err
+		}
+		if err = updateFeed(conn, gallery, nil, removed); err != nil {
+			return err
+		}
+		if err = updateTags(conn, gallery, nil, removed); err != nil {
+			return err
+		}
+
+		if _, err = conn.Do("HDEL", "images", bp); err != nil {
+			return err
+		}
+		if _, err = conn.Do("HDEL", "dirthumb", bp); err != nil {
+			return err
+		}
+	}
+
+	cache.DeletePrefix(basePath)
+	log.Info("Forgot %d missing folder(s) under %s", len(basePaths), basePath)
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default wall-clock timeouts for external tools, in seconds
+var toolTimeouts = map[string]int{
+	"convert": 30,
+	"ffmpeg":  300,
+}
+
+// Limits for an external tool
+type ToolConfig struct {
+	Timeout     int
+	Nice        int
+	IONiceClass int
+	IONiceLevel int
+	MemoryLimit int
+	CPULimit    int
+	Limit       []string
+}
+
+// Get the config for a tool, falling back to the defaults. It's a copy, Config is shared
+// by every request.
+func getTool(name string) *ToolConfig {
+	var tool ToolConfig
+	if t, ok := Config.Tool[name]; ok {
+		tool = *t
+	}
+	if tool.Timeout == 0 {
+		tool.Timeout = toolTimeouts[name]
+	}
+	return &tool
+}
+
+// Run an external tool with the configured limits, returning the combined output
+func runTool(name string, args ...string) ([]byte, error) {
+	tool := getTool(name)
+
+	ctx := context.Background()
+	if tool.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(tool.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	// ImageMagick resource policy, "memory 256MiB" -> -limit memory 256MiB
+	if name == "convert" {
+		for _, limit := range tool.Limit {
+			parts := strings.Fields(limit)
+			if len(parts) != 2 {
+				log.Warning("runTool(%s) ignoring bad limit %q", name, limit)
+				continue
+			}
+			args = append([]string{"-limit", parts[0], parts[1]}, args...)
+		}
+	}
+
+	// Wrap the command in prlimit/nice/ionice as required. These all exec the next
+	// command in the chain, so cancelling the context kills the tool itself.
+	argv := append([]string{name}, args...)
+	if tool.MemoryLimit > 0 || tool.CPULimit > 0 {
+		wrap := []string{"prlimit"}
+		if tool.MemoryLimit > 0 {
+			wrap = append(wrap, fmt.Sprintf("--as=%d", tool.MemoryLimit*1024*1024))
+		}
+		if tool.CPULimit > 0 {
+			wrap = append(wrap, fmt.Sprintf("--cpu=%d", tool.CPULimit))
+		}
+		argv = append(append(wrap, "--"), argv...)
+	}
+	if tool.Nice != 0 {
+		argv = append([]string{"nice", "-n", strconv.Itoa(tool.Nice)}, argv...)
+	}
+	if tool.IONiceClass != 0 {
+		wrap := []string{"ionice", "-c", strconv.Itoa(tool.IONiceClass)}
+		// Only realtime and best-effort have levels
+		if tool.IONiceClass == 1 || tool.IONiceClass == 2 {
+			wrap = append(wrap, "-n", strconv.Itoa(tool.IONiceLevel))
+		}
+		argv = append(wrap, argv...)
+	}
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		out = append(out, fmt.Sprintf("\n%s timed out after %ds", name, tool.Timeout)...)
+		err = ctx.Err()
+	}
+
+	return out, err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TREE_CACHE_TIME = time.Duration(5) * time.Minute
+	// Stop walking after this many folders, nobody is going to scroll through more
+	TREE_MAX_DIRS = 10000
+)
+
+// A folder in the tree, children are sorted by name
+type TreeNode struct {
+	Name  string      `json:"n"`
+	Title string      `json:"t,omitempty"`
+	Dirs  []*TreeNode `json:"d,omitempty"`
+}
+
+// A breadcrumb, the last one is the current folder
+type Crumb struct {
+	Name    string
+	Path    string
+	Current bool
+}
+
+// Walking big galleries is slow, so keep the trees around for a while
+var treeCache = struct {
+	sync.Mutex
+	Trees   map[string]*TreeNode
+	Updated map[string]time.Time
+}{
+	Trees:   make(map[string]*TreeNode),
+	Updated: make(map[string]time.Time),
+}
+
+// Serve the folder tree for a gallery as JSON
+func TreeHandler(w http.ResponseWriter, r *http.Request) {
+	// Check the gallery header
+	g := getGallery(r)
+	if g == "" {
+		http.NotFound(w, r)
+		return
+	}
+	gallery := Config.Gallery[g]
+
+	if !gallery.FolderTree {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, getTree(gallery))
+}
+
+// Get the folder tree for a gallery, from the cache if it's fresh enough
+func getTree(gallery *GalleryConfig) *TreeNode {
+	treeCache.Lock()
+	defer treeCache.Unlock()
+
+	root, ok := treeCache.Trees[gallery.ImagePath]
+	if !ok || time.Since(treeCache.Updated[gallery.ImagePath]) > TREE_CACHE_TIME {
+		count := 0
+		root = &TreeNode{Name: gallery.Name}
+		walkTree(gallery, gallery.ImagePath, root, &count)
+
+		treeCache.Trees[gallery.ImagePath] = root
+		treeCache.Updated[gallery.ImagePath] = time.Now()
+	}
+
+	return root
+}
+
+// Forget the tree for a gallery, after folders have been added
+func forgetTree(gallery *GalleryConfig) {
+	treeCache.Lock()
+	defer treeCache.Unlock()
+
+	delete(treeCache.Trees, gallery.ImagePath)
+	delete(treeCache.Updated, gallery.ImagePath)
+}
+
+// Forget every tree
+func flushTrees() {
+	treeCache.Lock()
+	defer treeCache.Unlock()
+
+	treeCache.Trees = make(map[string]*TreeNode)
+	treeCache.Updated = make(map[string]time.Time)
+}
+
+// Add the subfolders of dirPath to node, same rules as ScanFolder. Symlinked folders are
+// listed but not walked, so loops can't happen.
+func walkTree(gallery *GalleryConfig, dirPath string, node *TreeNode, count *int) {
+	fileInfos, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		log.Warning("walkTree(%s): %s", dirPath, err.Error())
+		return
+	}
+
+	relDir := gallery.relPath(dirPath)
+	for _, fi := range fileInfos {
+		if *count >= TREE_MAX_DIRS {
+			return
+		}
+
+		subPath := path.Join(dirPath, fi.Name())
+		isLink := fi.Mode()&os.ModeSymlink != 0
+		if isLink {
+			if fi, err = gallery.statSymlink(subPath); err != nil {
+				continue
+			}
+		}
+
+		if !fi.IsDir() || gallery.Excluded(path.Join(relDir, fi.Name()), true) {
+			continue
+		}
+
+		*count++
+		child := &TreeNode{
+			Name:  fi.Name(),
+			Title: loadFolderTitle(subPath),
+		}
+		node.Dirs = append(node.Dirs, child)
+
+		if !isLink {
+			walkTree(gallery, subPath, child, count)
+		}
+	}
+
+	sort.Sort(byTreeName(node.Dirs))
+}
+
+type byTreeName []*TreeNode
+
+func (a byTreeName) Len() int           { return len(a) }
+func (a byTreeName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTreeName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// Build breadcrumbs for a folder from its URL path, e.g. /2014/summer/
+func getCrumbs(gallery *GalleryConfig, urlPath string) []Crumb {
+	crumbs := []Crumb{
+		{Name: gallery.Name, Path: gallery.BaseURL},
+	}
+
+	dirPath := gallery.ImagePath
+	crumbPath := gallery.BaseURL
+	for _, part := range strings.Split(strings.Trim(urlPath, "/"), "/") {
+		if part == "" {
+			continue
+		}
+
+		dirPath = path.Join(dirPath, part)
+		crumbPath = path.Join(crumbPath, part) + "/"
+
+		// Use the folder title if it has one
+		name := loadFolderTitle(dirPath)
+		if name == "" {
+			name = strings.Replace(part, "_", " ", -1)
+		}
+
+		crumbs = append(crumbs, Crumb{Name: name, Path: crumbPath})
+	}
+
+	crumbs[len(crumbs)-1].Current = true
+
+	return crumbs
+}
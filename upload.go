@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	UPLOAD_PART_PREFIX = ".gollery-upload-"
+	UPLOAD_MAX_NAME    = 200
+	// Default upload size limit in MiB
+	UPLOAD_MAX_SIZE = 50
+	// Unfinished resumable uploads are thrown away after this long without a new chunk
+	UPLOAD_PART_EXPIRY = 24 * time.Hour
+)
+
+var (
+	reUnsafe = regexp.MustCompile("[^A-Za-z0-9._ -]+")
+)
+
+// Content types we accept, checked against the start of the file
+var uploadTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+type uploadError struct {
+	Status  int
+	Message string
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
+// Upload files to a gallery folder. A plain POST is a multipart form with one or more
+// "files", a POST with ?name=&offset=&total= appends a chunk of a resumable upload and
+// a GET with ?name= returns how much of a resumable upload we already have.
+func UploadHandler(w http.ResponseWriter, r *http.Request) {
+	gallery, folderPath, ok := checkUpload(w, r)
+	if !ok {
+		return
+	}
+
+	// Tidy up after uploads that never finished
+	if fileInfos, err := ioutil.ReadDir(folderPath); err == nil {
+		expireUploadParts(folderPath, fileInfos)
+	}
+
+	name := r.URL.Query().Get("name")
+	switch {
+	case r.Method == "GET" && name != "":
+		uploadChunkStatus(w, r, folderPath, name)
+	case r.Method == "POST" && name != "":
+		uploadChunk(w, r, gallery, folderPath, name)
+	case r.Method == "POST":
+		uploadMultipart(w, r, gallery, folderPath)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Create a new folder
+func MkdirHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gallery, folderPath, ok := checkUpload(w, r)
+	if !ok {
+		return
+	}
+
+	name := sanitiseFilename(r.FormValue("name"))
+	if name == "" {
+		uploadResponse(w, r, gallery, http.StatusBadRequest, map[string]interface{}{"error": "invalid folder name"})
+		return
+	}
+
+	if err := os.Mkdir(path.Join(folderPath, name), 0755); err != nil {
+		if os.IsExist(err) {
+			uploadResponse(w, r, gallery, http.StatusConflict, map[string]interface{}{"error": "folder already exists"})
+		} else {
+			log.Error("MkdirHandler: %s", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	cache.Delete(folderPath)
+	forgetTree(gallery)
+
+	uploadResponse(w, r, gallery, http.StatusOK, map[string]interface{}{"name": name})
+}
+
+// Make sure uploads are enabled, the user is allowed and the folder exists
+func checkUpload(w http.ResponseWriter, r *http.Request) (*GalleryConfig, string, bool) {
+	// Check the gallery header
+	g := getGallery(r)
+	if g == "" {
+		http.NotFound(w, r)
+		return nil, "", false
+	}
+	gallery := Config.Gallery[g]
+
+	if !gallery.Upload {
+		http.NotFound(w, r)
+		return nil, "", false
+	}
+
+	if !checkBasicAuth(r, gallery.UploadUsername, gallery.UploadPassword) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", gallery.Name))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, "", false
+	}
+	if !checkSameOrigin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, "", false
+	}
+
+	// Check path
+	cleanPath, err := gallery.resolveImagePath(r.URL.Path)
+	if err != nil || gallery.PathExcluded(gallery.relPath(cleanPath), true) {
+		http.NotFound(w, r)
+		return nil, "", false
+	}
+	if fi, err := os.Stat(cleanPath); err != nil || !fi.IsDir() {
+		http.NotFound(w, r)
+		return nil, "", false
+	}
+
+	return gallery, cleanPath, true
+}
+
+func uploadMultipart(w http.ResponseWriter, r *http.Request, gallery *GalleryConfig, folderPath string) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		uploadResponse(w, r, gallery, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	var uploaded []string
+	errors := make(map[string]string)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			uploadResponse(w, r, gallery, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+			return
+		}
+
+		if part.FormName() != "files" || part.FileName() == "" {
+			continue
+		}
+
+		name, err := saveUpload(folderPath, part.FileName(), part, gallery.uploadMaxSize())
+		if err != nil {
+			errors[part.FileName()] = err.Error()
+		} else {
+			uploaded = append(uploaded, name)
+		}
+	}
+
+	if len(uploaded) > 0 {
+		queueUploaded(gallery, folderPath)
+	}
+
+	status := http.StatusOK
+	data := map[string]interface{}{
+		"files":  uploaded,
+		"errors": errors,
+	}
+	if len(uploaded) == 0 && len(errors) > 0 {
+		status = http.StatusBadRequest
+		for fileName, msg := range errors {
+			data["error"] = fmt.Sprintf("%s: %s", fileName, msg)
+		}
+	}
+
+	uploadResponse(w, r, gallery, status, data)
+}
+
+func uploadChunkStatus(w http.ResponseWriter, r *http.Request, folderPath string, name string) {
+	name = sanitiseFilename(name)
+
+	var offset int64
+	if fi, err := os.Stat(uploadPartPath(folderPath, name)); err == nil {
+		offset = fi.Size()
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"name":   name,
+		"offset": offset,
+	})
+}
+
+func uploadChunk(w http.ResponseWriter, r *http.Request, gallery *GalleryConfig, folderPath string, name string) {
+	name = sanitiseFilename(name)
+	if err := checkUploadName(folderPath, name); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	offset, err1 := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	total, err2 := strconv.ParseInt(r.URL.Query().Get("total"), 10, 64)
+	if err1 != nil || err2 != nil || offset < 0 || total <= 0 || offset > total {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid offset or total"})
+		return
+	}
+	if total > gallery.uploadMaxSize() {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]interface{}{"error": "file too large"})
+		return
+	}
+
+	partPath := uploadPartPath(folderPath, name)
+	f, err := os.OpenFile(partPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Error("uploadChunk: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// The client has to carry on from wherever we got to
+	fi, err := f.Stat()
+	if err != nil {
+		log.Error("uploadChunk: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if fi.Size() != offset {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"error":  "wrong offset",
+			"name":   name,
+			"offset": fi.Size(),
+		})
+		return
+	}
+
+	n, err := io.Copy(f, io.LimitReader(r.Body, total-offset))
+	offset += n
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  err.Error(),
+			"name":   name,
+			"offset": offset,
+		})
+		return
+	}
+
+	// Not done yet
+	if offset < total {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"name":     name,
+			"offset":   offset,
+			"complete": false,
+		})
+		return
+	}
+
+	// All there, check it and move it into place
+	f.Close()
+	pf, err := os.Open(partPath)
+	if err != nil {
+		log.Error("uploadChunk: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	name, err = saveUpload(folderPath, name, pf, total)
+	pf.Close()
+	os.Remove(partPath)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	queueUploaded(gallery, folderPath)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"name":     name,
+		"offset":   offset,
+		"complete": true,
+	})
+}
+
+// Save an uploaded file into a folder, refusing to overwrite anything
+func saveUpload(folderPath string, fileName string, rd io.Reader, maxSize int64) (string, error) {
+	name := sanitiseFilename(fileName)
+	if err := checkUploadName(folderPath, name); err != nil {
+		return "", err
+	}
+
+	// Check the file type
+	br := bufio.NewReaderSize(rd, 512)
+	head, _ := br.Peek(512)
+	if contentType := http.DetectContentType(head); !uploadTypes[contentType] {
+		return "", &uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported file type: %s", contentType)}
+	}
+
+	f, err := ioutil.TempFile(folderPath, UPLOAD_PART_PREFIX)
+	if err != nil {
+		return "", err
+	}
+	tempPath := f.Name()
+	defer os.Remove(tempPath)
+
+	n, err := io.Copy(f, io.LimitReader(br, maxSize+1))
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if n > maxSize {
+		return "", &uploadError{http.StatusRequestEntityTooLarge, "file too large"}
+	}
+
+	// Link fails if the file exists, unlike Rename
+	if err = os.Link(tempPath, path.Join(folderPath, name)); err != nil {
+		if os.IsExist(err) {
+			return "", &uploadError{http.StatusConflict, "file already exists"}
+		}
+		return "", err
+	}
+
+	return name, nil
+}
+
+// Make sure a sanitised name is usable
+func checkUploadName(folderPath string, name string) error {
+	if name == "" || !reImage.MatchString(name) {
+		return &uploadError{http.StatusBadRequest, "invalid file name"}
+	}
+	if _, err := os.Stat(path.Join(folderPath, name)); err == nil {
+		return &uploadError{http.StatusConflict, "file already exists"}
+	}
+	return nil
+}
+
+// Forget the cached listing and thumbnail the new files in the background
+func queueUploaded(gallery *GalleryConfig, folderPath string) {
+	cache.Delete(folderPath)
+
+	go func() {
+		if _, _, _, err := tn.ScanFolder(gallery, folderPath); err != nil {
+			log.Error("queueUploaded(%s): %s", folderPath, err.Error())
+		}
+	}()
+}
+
+// Strip anything nasty out of a user supplied file name
+func sanitiseFilename(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	name = reUnsafe.ReplaceAllString(name, "_")
+	name = strings.TrimLeft(name, ". ")
+
+	if len(name) > UPLOAD_MAX_NAME {
+		ext := path.Ext(name)
+		if len(ext) > 10 {
+			ext = ""
+		}
+		name = name[:UPLOAD_MAX_NAME-len(ext)] + ext
+	}
+
+	return name
+}
+
+func uploadPartPath(folderPath string, name string) string {
+	return path.Join(folderPath, UPLOAD_PART_PREFIX+name+".part")
+}
+
+// Remove partial uploads that haven't been touched for UPLOAD_PART_EXPIRY
+func expireUploadParts(folderPath string, fileInfos []os.FileInfo) {
+	for _, fi := range fileInfos {
+		if strings.HasPrefix(fi.Name(), UPLOAD_PART_PREFIX) && strings.HasSuffix(fi.Name(), ".part") &&
+			fi.Mode().IsRegular() && time.Since(fi.ModTime()) > UPLOAD_PART_EXPIRY {
+			if err := os.Remove(path.Join(folderPath, fi.Name())); err != nil {
+				log.Warning("expireUploadParts: %s", err.Error())
+			} else {
+				log.Info("Removed abandoned upload %s", path.Join(folderPath, fi.Name()))
+			}
+		}
+	}
+}
+
+// Maximum upload size in bytes
+func (g *GalleryConfig) uploadMaxSize() int64 {
+	if g.UploadMaxSize > 0 {
+		return int64(g.UploadMaxSize) * 1024 * 1024
+	}
+	return UPLOAD_MAX_SIZE * 1024 * 1024
+}
+
+// Send JSON to XHR requests, redirect plain form posts back to the folder
+func uploadResponse(w http.ResponseWriter, r *http.Request, gallery *GalleryConfig, status int, data map[string]interface{}) {
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		writeJSON(w, status, data)
+		return
+	}
+
+	if status != http.StatusOK {
+		http.Error(w, fmt.Sprintf("%v", data["error"]), status)
+		return
+	}
+	http.Redirect(w, r, path.Clean(gallery.BaseURL+r.URL.Path)+"/", http.StatusSeeOther)
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	if ue, ok := err.(*uploadError); ok {
+		writeJSON(w, ue.Status, map[string]interface{}{"error": ue.Message})
+		return
+	}
+
+	log.Error("upload: %s", err.Error())
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Error("writeJSON: %s", err.Error())
+	}
+}
@@ -6,10 +6,10 @@ import (
 	"image/gif"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,86 +20,132 @@ var (
 	test  = "\x00\x21\xF9\x04baaa\x00\x2Czzzzzzzz\x00\x21\xF9\x04boooo\x00\x2C"
 )
 
-func VideoMaker() chan FolderData {
-	// Get a Redis connection
-	conn := redisPool.Get()
-	defer conn.Close()
+// What VideoMaker is working on right now, for the admin UI
+var vmCurrent struct {
+	sync.Mutex
+	BasePath string
+	Started  time.Time
+}
 
+func VideoMaker() chan FolderData {
 	c := make(chan FolderData, 1000)
 
 	go func() {
-		var start time.Time
-
 		for fd := range c {
-			start = time.Now()
-
-			key := fmt.Sprintf("webm:%s", fd.BasePath)
-
 			// Bail if this gallery doesn't have a video path
 			if fd.Gallery.VideoPath == "" {
 				log.Debug("VideoMaker(%s) has no VideoPath configured", fd.BasePath)
 				continue
 			}
 
-			for fileName, imageInfo := range *fd.FileMap {
-				t := time.Now()
-
-				// Don't care about non-GIFs
-				fileMatches := reGIF.FindAllStringSubmatch(fileName, -1)
-				if len(fileMatches) == 0 {
-					continue
-				}
-
-				// See if the video file already exists
-				videoName := strings.Replace(imageInfo.ThumbPath, ".jpg", ".webm", 1)
-				videoPath := path.Join(fd.Gallery.VideoPath, videoName)
-				if _, err := os.Stat(videoPath); err == nil {
-					//log.Debug("VideoMaker(%s) file exists %s", fd.BasePath, videoPath)
-					continue
-				}
-
-				//log.Debug("VideoMaker(%s) file does not exist %s", fd.BasePath, videoPath)
-
-				// asdf
-				filePath := path.Join(fd.BasePath, fileName)
-
-				// Read the file
-				b, err := ioutil.ReadFile(filePath)
-				if err != nil {
-					log.Warning("VideoMaker(%s) unable to read file %s: %s", fd.BasePath, fileName, err.Error())
-					continue
-				}
-
-				// Decode the GIF
-				buf := bytes.NewBuffer(b)
-				g, err := gif.DecodeAll(buf)
-				if err != nil {
-					log.Warning("VideoMaker(%s) unable to decode GIF %s: %s", fd.BasePath, fileName, err.Error())
-					continue
-				}
-
-				// Skip non-animated GIFs
-				if len(g.Image) <= 1 {
-					log.Debug("VideoMaker(%s) not animated %s", fd.BasePath, fileName)
-					continue
-				}
-
-				// Now we can finally make a webm
-				cmd := exec.Command("ffmpeg", "-i", filePath, "-c:v", "libvpx", "-threads", "0", "-an", "-crf", "4", "-b:v", "1000k", videoPath)
-				if err = cmd.Run(); err != nil {
-					log.Warning("VideoMaker(%s) unable to make webm %s: %s", fd.BasePath, fileName, err.Error())
-					continue
-				}
-
-				// Save to Redis
-				conn.Do("HSET", key, imageInfo.ImagePath, videoName)
-
-				log.Debug("VideoMaker(%s) webm of %s took %s", fd.BasePath, fileName, time.Since(t))
-			}
+			vmCurrent.Lock()
+			vmCurrent.BasePath, vmCurrent.Started = fd.BasePath, time.Now()
+			vmCurrent.Unlock()
+
+			makeVideos(fd)
 
-			log.Debug("VideoMaker(%s) took %s", fd.BasePath, time.Since(start))
+			vmCurrent.Lock()
+			vmCurrent.BasePath = ""
+			vmCurrent.Unlock()
 		}
 	}()
 
 	return c
 }
+
+// Make webm videos for any animated GIFs in a folder
+func makeVideos(fd FolderData) {
+	start := time.Now()
+
+	// Get a Redis connection
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("webm:%s", fd.BasePath)
+
+	for fileName, imageInfo := range *fd.FileMap {
+		t := time.Now()
+
+		// Don't care about non-GIFs
+		fileMatches := reGIF.FindAllStringSubmatch(fileName, -1)
+		if len(fileMatches) == 0 {
+			continue
+		}
+
+		// See if the video file already exists
+		videoName := strings.Replace(imageInfo.ThumbPath, ".jpg", ".webm", 1)
+		videoPath := path.Join(fd.Gallery.VideoPath, videoName)
+		if _, err := os.Stat(videoPath); err == nil {
+			//log.Debug("VideoMaker(%s) file exists %s", fd.BasePath, videoPath)
+			continue
+		}
+
+		//log.Debug("VideoMaker(%s) file does not exist %s", fd.BasePath, videoPath)
+
+		// asdf
+		filePath := path.Join(fd.BasePath, fileName)
+
+		// Skip files that failed before, unless they have changed since
+		failure, err := getFailure(conn, FAILED_FFMPEG, filePath)
+		if err != nil {
+			log.Error("VideoMaker(%s) unable to fetch failure for %s: %s", fd.BasePath, fileName, err.Error())
+			continue
+		}
+		if failure.Matches(imageInfo.FileSize, imageInfo.ModTime) {
+			continue
+		}
+
+		// Read the file
+		b, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			log.Warning("VideoMaker(%s) unable to read file %s: %s", fd.BasePath, fileName, err.Error())
+			continue
+		}
+
+		// Check the size first, decoding every frame of a huge GIF can use all of the memory
+		gc, err := gif.DecodeConfig(bytes.NewReader(b))
+		if err == nil && Config.Global.MaxPixels > 0 && gc.Width*gc.Height > Config.Global.MaxPixels {
+			err = fmt.Errorf("image too large: %dx%d is more than %d pixels", gc.Width, gc.Height, Config.Global.MaxPixels)
+		}
+		if err != nil {
+			log.Warning("VideoMaker(%s) refusing GIF %s: %s", fd.BasePath, fileName, err.Error())
+			recordFailure(conn, FAILED_FFMPEG, filePath, imageInfo.FileSize, imageInfo.ModTime, err.Error())
+			continue
+		}
+
+		// Decode the GIF
+		buf := bytes.NewBuffer(b)
+		g, err := gif.DecodeAll(buf)
+		if err != nil {
+			log.Warning("VideoMaker(%s) unable to decode GIF %s: %s", fd.BasePath, fileName, err.Error())
+			recordFailure(conn, FAILED_FFMPEG, filePath, imageInfo.FileSize, imageInfo.ModTime, err.Error())
+			continue
+		}
+
+		// Skip non-animated GIFs
+		if len(g.Image) <= 1 {
+			log.Debug("VideoMaker(%s) not animated %s", fd.BasePath, fileName)
+			continue
+		}
+
+		// Now we can finally make a webm
+		if out, err := runTool("ffmpeg", "-i", filePath, "-c:v", "libvpx", "-threads", "0", "-an", "-crf", "4", "-b:v", "1000k", videoPath); err != nil {
+			log.Warning("VideoMaker(%s) unable to make webm %s: %s", fd.BasePath, fileName, err.Error())
+			recordFailure(conn, FAILED_FFMPEG, filePath, imageInfo.FileSize, imageInfo.ModTime, string(out))
+			// Don't leave a partial webm lying around
+			os.Remove(videoPath)
+			continue
+		}
+
+		// Save to Redis
+		conn.Do("HSET", key, imageInfo.ImagePath, videoName)
+		if failure != nil {
+			clearFailure(conn, FAILED_FFMPEG, filePath)
+		}
+
+		metricTranscodeDuration.Observe(time.Since(t).Seconds())
+		log.Debug("VideoMaker(%s) webm of %s took %s", fd.BasePath, fileName, time.Since(t))
+	}
+
+	log.Debug("VideoMaker(%s) took %s", fd.BasePath, time.Since(start))
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	NS_DC  = "http://purl.org/dc/elements/1.1/"
+	NS_RDF = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	NS_XMP = "http://ns.adobe.com/xap/1.0/"
+
+	// IPTC IIM datasets in record 2
+	IPTC_TITLE     = 5
+	IPTC_KEYWORDS  = 25
+	IPTC_CREATOR   = 80
+	IPTC_COPYRIGHT = 116
+	IPTC_CAPTION   = 120
+)
+
+var (
+	xmpStart = []byte("<x:xmpmeta")
+	xmpEnd   = []byte("</x:xmpmeta>")
+)
+
+// The IPTC/XMP bits we care about, the same things Lightroom lets you edit
+type ImageMeta struct {
+	Title       string
+	Description string
+	Keywords    []string
+	Rating      int
+	Copyright   string
+	Creator     string
+}
+
+// Read metadata from an image and its .xmp sidecar (if any). The sidecar wins, then
+// embedded XMP, then IPTC. Keywords from all of them are merged.
+func readImageMeta(b []byte, sidecar []byte) ImageMeta {
+	var m ImageMeta
+
+	sources := []map[string][]string{
+		parseXMP(findXMP(sidecar)),
+		parseXMP(findXMP(b)),
+		iptcProps(parseIPTC(b)),
+	}
+
+	var keywords []string
+	for _, props := range sources {
+		m.Title = firstString(m.Title, props[NS_DC+"title"])
+		m.Description = firstString(m.Description, props[NS_DC+"description"])
+		m.Copyright = firstString(m.Copyright, props[NS_DC+"rights"])
+		m.Creator = firstString(m.Creator, props[NS_DC+"creator"])
+		if m.Rating == 0 && len(props[NS_XMP+"Rating"]) > 0 {
+			// -1 means rejected, we only care about stars
+			if rating, err := strconv.Atoi(props[NS_XMP+"Rating"][0]); err == nil && rating > 0 && rating <= 5 {
+				m.Rating = rating
+			}
+		}
+		keywords = append(keywords, props[NS_DC+"subject"]...)
+	}
+	m.Keywords = normaliseTags(keywords)
+
+	return m
+}
+
+// Keep the current value, or use the first new one
+func firstString(current string, values []string) string {
+	if current != "" || len(values) == 0 {
+		return current
+	}
+	return values[0]
+}
+
+// Map IPTC datasets to the matching XMP properties so they can be treated the same way
+func iptcProps(datasets map[int][]string) map[string][]string {
+	return map[string][]string{
+		NS_DC + "title":       datasets[IPTC_TITLE],
+		NS_DC + "description": datasets[IPTC_CAPTION],
+		NS_DC + "subject":     datasets[IPTC_KEYWORDS],
+		NS_DC + "creator":     datasets[IPTC_CREATOR],
+		NS_DC + "rights":      datasets[IPTC_COPYRIGHT],
+	}
+}
+
+// Find an image's sidecar, Lightroom uses IMG_0001.xmp and some other things use
+// IMG_0001.jpg.xmp. sidecars is lowercased name -> file for the folder.
+func findSidecar(sidecars map[string]os.FileInfo, fileName string) os.FileInfo {
+	lower := strings.ToLower(fileName)
+	if fi, ok := sidecars[lower+".xmp"]; ok {
+		return fi
+	}
+	return sidecars[strings.TrimSuffix(lower, path.Ext(lower))+".xmp"]
+}
+
+// Find an XMP packet in the file. It's the same XML whether it lives in a JPEG APP1 segment,
+// a PNG iTXt chunk or a GIF extension, so just go looking for it.
+func findXMP(b []byte) []byte {
+	start := bytes.Index(b, xmpStart)
+	if start < 0 {
+		return nil
+	}
+	end := bytes.Index(b[start:], xmpEnd)
+	if end < 0 {
+		return nil
+	}
+	return b[start : start+end+len(xmpEnd)]
+}
+
+// Parse XMP into "namespace+name" -> values. Properties can be attributes of rdf:Description,
+// simple elements, or rdf:Bag/Seq/Alt lists of rdf:li.
+func parseXMP(b []byte) map[string][]string {
+	props := make(map[string][]string)
+	if len(b) == 0 {
+		return props
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+
+	// The rdf:Description and property we're inside, and the text collected for it
+	var prop string
+	var text strings.Builder
+	depth, descDepth, propDepth := 0, 0, 0
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if prop == "" && t.Name.Space == NS_RDF && t.Name.Local == "Description" {
+				descDepth = depth
+				for _, attr := range t.Attr {
+					if attr.Name.Space != NS_RDF && attr.Name.Space != "xmlns" && attr.Name.Space != "" {
+						props[attr.Name.Space+attr.Name.Local] = append(props[attr.Name.Space+attr.Name.Local], attr.Value)
+					}
+				}
+			} else if prop == "" && descDepth > 0 && depth == descDepth+1 {
+				prop = t.Name.Space + t.Name.Local
+				propDepth = depth
+				text.Reset()
+			} else if t.Name.Space == NS_RDF {
+				text.Reset()
+			}
+
+		case xml.CharData:
+			if prop != "" {
+				text.Write(t)
+			}
+
+		case xml.EndElement:
+			if prop != "" {
+				// Either a list item or the property itself if it was a simple one
+				if (t.Name.Space == NS_RDF && t.Name.Local == "li") || depth == propDepth {
+					if s := strings.TrimSpace(text.String()); s != "" {
+						props[prop] = append(props[prop], s)
+					}
+					text.Reset()
+				}
+				if depth == propDepth {
+					prop = ""
+				}
+			} else if depth == descDepth {
+				descDepth = 0
+			}
+			depth--
+		}
+	}
+
+	return props
+}
+
+// Parse IPTC IIM record 2 datasets out of a JPEG's Photoshop APP13 segment
+func parseIPTC(b []byte) map[int][]string {
+	datasets := make(map[int][]string)
+
+	iim := findIPTC(b)
+	for len(iim) >= 5 && iim[0] == 0x1c {
+		record, dataset := iim[1], int(iim[2])
+		size := int(binary.BigEndian.Uint16(iim[3:5]))
+		// Extended sizes are only used for huge datasets that we don't care about
+		if size&0x8000 != 0 || len(iim) < 5+size {
+			break
+		}
+		if record == 2 {
+			if s := strings.TrimSpace(iptcString(iim[5 : 5+size])); s != "" {
+				datasets[dataset] = append(datasets[dataset], s)
+			}
+		}
+		iim = iim[5+size:]
+	}
+
+	return datasets
+}
+
+// Find the IPTC resource (8BIM 0x0404) in a JPEG
+func findIPTC(b []byte) []byte {
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return nil
+	}
+
+	for i := 2; i+4 <= len(b) && b[i] == 0xff; {
+		marker := b[i+1]
+		size := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+		// Start of scan, metadata is over
+		if marker == 0xda || size < 2 || i+2+size > len(b) {
+			break
+		}
+
+		segment := b[i+4 : i+2+size]
+		if marker == 0xed && bytes.HasPrefix(segment, []byte("Photoshop 3.0\x00")) {
+			return find8BIM(segment[14:], 0x0404)
+		}
+
+		i += 2 + size
+	}
+
+	return nil
+}
+
+// Find a Photoshop image resource by ID
+func find8BIM(b []byte, id uint16) []byte {
+	for len(b) >= 12 && bytes.HasPrefix(b, []byte("8BIM")) {
+		resID := binary.BigEndian.Uint16(b[4:6])
+		// Pascal string name, padded to an even length
+		nameLen := int(b[6]) + 1
+		if nameLen%2 != 0 {
+			nameLen++
+		}
+		if len(b) < 6+nameLen+4 {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(b[6+nameLen : 6+nameLen+4]))
+		data := b[6+nameLen+4:]
+		if size > len(data) {
+			break
+		}
+		if resID == id {
+			return data[:size]
+		}
+		if size%2 != 0 {
+			size++
+		}
+		if size > len(data) {
+			break
+		}
+		b = data[size:]
+	}
+
+	return nil
+}
+
+// IPTC strings are UTF-8 these days, older files are usually Latin-1
+func iptcString(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmp:Rating="4">
+   <dc:title>
+    <rdf:Alt>
+     <rdf:li xml:lang="x-default">Red car</rdf:li>
+    </rdf:Alt>
+   </dc:title>
+   <dc:subject>
+    <rdf:Bag>
+     <rdf:li>car</rdf:li>
+     <rdf:li>Red</rdf:li>
+    </rdf:Bag>
+   </dc:subject>
+   <dc:creator>
+    <rdf:Seq>
+     <rdf:li>Freddie</rdf:li>
+    </rdf:Seq>
+   </dc:creator>
+   <xmp:Label>Green</xmp:Label>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+// An IIM dataset
+func iimDataset(record, dataset byte, value string) []byte {
+	b := []byte{0x1c, record, dataset, 0, 0}
+	binary.BigEndian.PutUint16(b[3:5], uint16(len(value)))
+	return append(b, value...)
+}
+
+// A Photoshop image resource with an empty name
+func resource8BIM(id uint16, data []byte) []byte {
+	b := []byte("8BIM")
+	b = append(b, byte(id>>8), byte(id), 0, 0)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(data)))
+	b = append(b, size...)
+	b = append(b, data...)
+	if len(data)%2 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// A JPEG with just SOI, an APP13 segment holding the resources and SOS
+func jpegAPP13(resources []byte) []byte {
+	segment := append([]byte("Photoshop 3.0\x00"), resources...)
+	b := []byte{0xff, 0xd8, 0xff, 0xed, 0, 0}
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(segment)+2))
+	b = append(b, segment...)
+	return append(b, 0xff, 0xda, 0, 2)
+}
+
+func TestParseXMP(t *testing.T) {
+	props := parseXMP(findXMP([]byte("junk" + testXMP + "more junk")))
+
+	tests := map[string][]string{
+		NS_DC + "title":    {"Red car"},
+		NS_DC + "subject":  {"car", "Red"},
+		NS_DC + "creator":  {"Freddie"},
+		NS_XMP + "Rating":  {"4"},
+		NS_XMP + "Label":   {"Green"},
+		NS_DC + "rights":   nil,
+		NS_RDF + "about":   nil,
+		"xmlns" + "dc":     nil,
+		NS_DC + "nonsense": nil,
+	}
+	for prop, want := range tests {
+		if got := props[prop]; !reflect.DeepEqual(got, want) {
+			t.Errorf("parseXMP %s = %q, want %q", prop, got, want)
+		}
+	}
+
+	// Broken or missing XMP is just empty
+	for _, b := range []string{"", "<x:xmpmeta>not really", testXMP[:len(testXMP)/2]} {
+		if props := parseXMP(findXMP([]byte(b))); len(props) != 0 {
+			t.Errorf("parseXMP(%q) = %v, want nothing", b, props)
+		}
+	}
+}
+
+func TestParseIPTC(t *testing.T) {
+	var iim []byte
+	iim = append(iim, iimDataset(1, 90, "\x1b%G")...)
+	iim = append(iim, iimDataset(2, IPTC_TITLE, "Beach")...)
+	iim = append(iim, iimDataset(2, IPTC_KEYWORDS, "sand")...)
+	iim = append(iim, iimDataset(2, IPTC_KEYWORDS, " sea ")...)
+	iim = append(iim, iimDataset(2, IPTC_CAPTION, "Caf\xe9")...)
+	iim = append(iim, iimDataset(2, IPTC_CREATOR, "")...)
+
+	got := parseIPTC(jpegAPP13(append(resource8BIM(0x03ed, []byte("other")), resource8BIM(0x0404, iim)...)))
+	want := map[int][]string{
+		IPTC_TITLE:    {"Beach"},
+		IPTC_KEYWORDS: {"sand", "sea"},
+		IPTC_CAPTION:  {"Café"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseIPTC = %q, want %q", got, want)
+	}
+
+	// Truncated datasets stop the parsing, anything before them is kept
+	truncated := append(iimDataset(2, IPTC_TITLE, "Beach"), 0x1c, 2, IPTC_CAPTION, 0, 50, 'x')
+	got = parseIPTC(jpegAPP13(resource8BIM(0x0404, truncated)))
+	if !reflect.DeepEqual(got, map[int][]string{IPTC_TITLE: {"Beach"}}) {
+		t.Errorf("parseIPTC truncated = %q", got)
+	}
+
+	// Not JPEGs, or no IPTC
+	for _, b := range [][]byte{nil, []byte("GIF89a"), jpegAPP13(nil), jpegAPP13(resource8BIM(0x03ed, []byte("other")))} {
+		if got := parseIPTC(b); len(got) != 0 {
+			t.Errorf("parseIPTC(%q) = %q, want nothing", b, got)
+		}
+	}
+}
+
+func TestFind8BIM(t *testing.T) {
+	// Odd sizes and names are padded to an even length
+	named := []byte("8BIM\x04\x04\x03abc\x00\x00\x00\x03xyz\x00")
+	resources := append(resource8BIM(0x03ed, []byte("odd")), named...)
+	resources = append(resources, resource8BIM(0x0409, []byte("last"))...)
+
+	tests := []struct {
+		id   uint16
+		want []byte
+	}{
+		{0x03ed, []byte("odd")},
+		{0x0404, []byte("xyz")},
+		{0x0409, []byte("last")},
+		{0x0425, nil},
+	}
+	for _, tt := range tests {
+		if got := find8BIM(resources, tt.id); !bytes.Equal(got, tt.want) {
+			t.Errorf("find8BIM(%#04x) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+
+	// Sizes running off the end are ignored rather than trusted
+	broken := resource8BIM(0x0404, []byte("data"))
+	binary.BigEndian.PutUint32(broken[8:12], 1000)
+	for _, b := range [][]byte{nil, []byte("8BIM"), broken, []byte("junkjunkjunkjunk")} {
+		if got := find8BIM(b, 0x0404); got != nil {
+			t.Errorf("find8BIM(%q) = %q, want nil", b, got)
+		}
+	}
+}
+
+func TestFindSidecar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gollery-xmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"IMG_0001.xmp", "img_0002.JPG.XMP", "IMG_0003.xmp", "IMG_0003.jpg.xmp"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(testXMP), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecars := make(map[string]os.FileInfo)
+	for _, fi := range fileInfos {
+		sidecars[strings.ToLower(fi.Name())] = fi
+	}
+
+	tests := []struct {
+		fileName, want string
+	}{
+		{"IMG_0001.jpg", "IMG_0001.xmp"},
+		{"IMG_0002.jpg", "img_0002.JPG.XMP"},
+		// IMG_0001.jpg.xmp style wins when there are both
+		{"IMG_0003.jpg", "IMG_0003.jpg.xmp"},
+		{"IMG_0004.jpg", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if fi := findSidecar(sidecars, tt.fileName); fi != nil {
+			got = fi.Name()
+		}
+		if got != tt.want {
+			t.Errorf("findSidecar(%q) = %q, want %q", tt.fileName, got, tt.want)
+		}
+	}
+}
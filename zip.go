@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const (
+	// Default limits for ZIP downloads
+	ZIP_MAX_FILES = 1000
+	ZIP_MAX_SIZE  = 1024
+)
+
+var errZipTooBig = errors.New("too many files for a ZIP")
+
+type zipFile struct {
+	FilePath string
+	Name     string
+	Info     os.FileInfo
+}
+
+// Stream a ZIP of every image in a folder, ?recursive=1 includes subfolders
+func ZipHandler(w http.ResponseWriter, r *http.Request) {
+	// Check the gallery header
+	g := getGallery(r)
+	if g == "" {
+		http.NotFound(w, r)
+		return
+	}
+	gallery := Config.Gallery[g]
+
+	// Check path
+	cleanPath, err := gallery.resolveImagePath(r.URL.Path)
+	if err != nil || gallery.PathExcluded(gallery.relPath(cleanPath), true) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if fi, err := os.Stat(cleanPath); err != nil || !fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Find the files, giving up as soon as there are too many
+	maxFiles, maxSize := gallery.zipLimits()
+	files, err := getZipFiles(gallery, cleanPath, r.URL.Query().Get("recursive") != "", maxFiles, maxSize)
+	if err == errZipTooBig {
+		http.Error(w, fmt.Sprintf("Too much to download at once (more than %d files or %s)", maxFiles, formatSize(maxSize)), http.StatusRequestEntityTooLarge)
+		return
+	} else if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Error("ZipHandler: %s", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(files) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Name the archive after the folder
+	zipName := path.Base(cleanPath)
+	if cleanPath == gallery.ImagePath {
+		zipName = gallery.Name
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": zipName + ".zip"}))
+
+	// Images are already compressed, so just store them
+	zw := zip.NewWriter(w)
+	for _, zf := range files {
+		fh, err := zip.FileInfoHeader(zf.Info)
+		if err != nil {
+			log.Error("ZipHandler: %s", err.Error())
+			return
+		}
+		fh.Name = zf.Name
+		fh.Method = zip.Store
+
+		zfw, err := zw.CreateHeader(fh)
+		if err != nil {
+			log.Warning("ZipHandler: %s", err.Error())
+			return
+		}
+
+		f, err := os.Open(zf.FilePath)
+		if err != nil {
+			log.Error("ZipHandler: %s", err.Error())
+			return
+		}
+		_, err = io.Copy(zfw, f)
+		f.Close()
+		if err != nil {
+			log.Warning("ZipHandler: %s", err.Error())
+			return
+		}
+	}
+
+	if err = zw.Close(); err != nil {
+		log.Warning("ZipHandler: %s", err.Error())
+	}
+}
+
+// Find the images in a folder, skipping excluded files and folders like ScanFolder does.
+// Symlinked folders aren't followed so a link to a parent can't loop, and the walk stops
+// with errZipTooBig once there are more than maxFiles files or maxSize bytes.
+func getZipFiles(gallery *GalleryConfig, basePath string, recursive bool, maxFiles int, maxSize int64) ([]zipFile, error) {
+	var files []zipFile
+	var totalSize int64
+
+	var walk func(dirPath string) error
+	walk = func(dirPath string) error {
+		fileInfos, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			return err
+		}
+
+		for _, fi := range fileInfos {
+			filePath := path.Join(dirPath, fi.Name())
+			relPath := gallery.relPath(filePath)
+
+			// Symlinks need checking against the gallery's policy
+			isLink := fi.Mode()&os.ModeSymlink != 0
+			if isLink {
+				if fi, err = gallery.statSymlink(filePath); err != nil {
+					continue
+				}
+			}
+
+			if fi.IsDir() {
+				if recursive && !isLink && !gallery.Excluded(relPath, true) {
+					if err = walk(filePath); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			if !fi.Mode().IsRegular() || !reImage.MatchString(fi.Name()) || gallery.Excluded(relPath, false) {
+				continue
+			}
+
+			name, _ := filepath.Rel(basePath, filePath)
+			files = append(files, zipFile{filePath, name, fi})
+
+			totalSize += fi.Size()
+			if len(files) > maxFiles || totalSize > maxSize {
+				return errZipTooBig
+			}
+		}
+
+		return nil
+	}
+
+	return files, walk(basePath)
+}
+
+// ZIP limits for a gallery, file count and bytes
+func (g *GalleryConfig) zipLimits() (int, int64) {
+	maxFiles, maxSize := g.ZipMaxFiles, g.ZipMaxSize
+	if maxFiles <= 0 {
+		maxFiles = ZIP_MAX_FILES
+	}
+	if maxSize <= 0 {
+		maxSize = ZIP_MAX_SIZE
+	}
+	return maxFiles, int64(maxSize) * 1024 * 1024
+}